@@ -0,0 +1,112 @@
+package gofcgisrv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Authorizer is the interface for anything that can run a FastCGI Authorizer request.
+// FCGIRequester is one.
+type Authorizer interface {
+	Authorize(env []string, stdout io.Writer, stderr io.Writer) error
+}
+
+// Wrapper for functions
+type AuthorizerFunc func(env []string, stdout io.Writer, stderr io.Writer) error
+
+func (f AuthorizerFunc) Authorize(env []string, stdout io.Writer, stderr io.Writer) error {
+	return f(env, stdout, stderr)
+}
+
+type authorizerEnvKey struct{}
+
+// AuthorizerEnv returns the variables an authorizer attached to r, as name=value pairs.
+// HTTPEnv adds them to the environment automatically.
+func AuthorizerEnv(r *http.Request) []string {
+	env, _ := r.Context().Value(authorizerEnvKey{}).([]string)
+	return env
+}
+
+// scriptVars are the variables an authorizer doesn't get, since it runs before
+// anything has decided on a script.
+var scriptVars = map[string]bool{
+	"SCRIPT_NAME":     true,
+	"SCRIPT_FILENAME": true,
+	"PATH_INFO":       true,
+	"PATH_TRANSLATED": true,
+}
+
+// AuthorizeHTTP runs an authorizer for an http request. If the application responds
+// with 200, the values of its Variable-* headers are returned as name=value pairs and ok is true.
+// Otherwise the application's response is written to w as-is and ok is false.
+// As the FastCGI spec has it, the script-specific variables are left out of the environment.
+func AuthorizeHTTP(a Authorizer, env []string, w http.ResponseWriter, r *http.Request) (vars []string, ok bool, err error) {
+	all := HTTPEnv(env, r)
+	env = make([]string, 0, len(all))
+	for _, e := range all {
+		if k, _, err := parseEnv(e); err == nil && !scriptVars[k] {
+			env = append(env, e)
+		}
+	}
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	if err := a.Authorize(env, stdout, stderr); err != nil {
+		return nil, false, err
+	}
+	output := stdout.Bytes()
+
+	// Header names are case-sensitive here, since they become variable names,
+	// so we can't use textproto.
+	status := http.StatusOK
+	reader := bufio.NewReader(bytes.NewReader(output))
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		idx := strings.Index(line, ":")
+		if idx > 0 {
+			name, value := line[:idx], strings.TrimSpace(line[idx+1:])
+			switch {
+			case strings.EqualFold(name, "Status"):
+				fmt.Sscanf(value, "%d", &status)
+			case len(name) > len("Variable-") && strings.EqualFold(name[:len("Variable-")], "Variable-"):
+				vars = append(vars, name[len("Variable-"):]+"="+value)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if status != http.StatusOK {
+		return nil, false, ProcessResponse(bytes.NewReader(output), w, r)
+	}
+	return vars, true, nil
+}
+
+// AuthorizerHandler returns a handler that runs the authorizer before passing
+// the request on to next. The authorizer's variables are attached to the request
+// passed to next; see AuthorizerEnv.
+func AuthorizerHandler(a Authorizer, env []string, next http.Handler) http.Handler {
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		vars, ok, err := AuthorizeHTTP(a, env, w, r)
+		if err != nil {
+			serveError(w, r, responseOptions{}, err)
+			return
+		}
+		if !ok {
+			return
+		}
+		vars = append(AuthorizerEnv(r), vars...)
+		ctx := context.WithValue(r.Context(), authorizerEnvKey{}, vars)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+	return http.HandlerFunc(serve)
+}
@@ -0,0 +1,86 @@
+package gofcgisrv
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFCGIAuthorize(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		if req.role != fcgiAuthorizer {
+			return fakeResponse{protocolStatus: fcgiUnknownRole}
+		}
+		if req.stdin.Len() != 0 {
+			t.Errorf("Authorizer got stdin %q", req.stdin.String())
+		}
+		for _, name := range []string{"SCRIPT_NAME", "PATH_INFO"} {
+			if _, ok := req.params[name]; ok {
+				t.Errorf("Authorizer got %s", name)
+			}
+		}
+		if req.params["REQUEST_URI"] != "/" {
+			t.Errorf("Authorizer got REQUEST_URI %q", req.params["REQUEST_URI"])
+		}
+		if req.params["HTTP_AUTHORIZATION"] != "letmein" {
+			return fakeResponse{stdout: "Status: 403 Forbidden\r\nX-Reason: password\r\n\r\nGo away"}
+		}
+		return fakeResponse{stdout: "Status: 200 OK\r\nVariable-AUTH_USER: fred\r\nVariable-Group: admin\r\nX-Ignored: yes\r\n\r\nignored body"}
+	})
+	defer app.Close()
+
+	a := NewFCGI(app.Addr())
+	server := httptest.NewServer(AuthorizerHandler(a, nil, makeHandler(RequesterFunc(headerRequester), nil)))
+	defer server.Close()
+
+	// Denied
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 403 || string(body) != "Go away" || resp.Header.Get("X-Reason") != "password" {
+		t.Errorf("Denied request got %d %v %q", resp.StatusCode, resp.Header, body)
+	}
+
+	// Allowed
+	req, _ := http.NewRequest("GET", server.URL+"/", nil)
+	req.Header.Set("Authorization", "letmein")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("Allowed request got %d", resp.StatusCode)
+	}
+	var envMap map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&envMap); err != nil {
+		t.Fatal(err)
+	}
+	if envMap["AUTH_USER"] != "fred" || envMap["Group"] != "admin" {
+		t.Errorf("Authorizer variables were not passed on: %v", envMap)
+	}
+	if _, ok := envMap["X-Ignored"]; ok {
+		t.Errorf("Non-variable header was passed on")
+	}
+}
+
+func TestAuthorizerFunc(t *testing.T) {
+	a := AuthorizerFunc(func(env []string, stdout io.Writer, stderr io.Writer) error {
+		io.WriteString(stdout, "Status: 401 Unauthorized\nWWW-Authenticate: Basic\n\n")
+		return nil
+	})
+	handler := AuthorizerHandler(a, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unauthorized request got through")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 401 || w.Header().Get("WWW-Authenticate") != "Basic" {
+		t.Errorf("Got %d %v", w.Code, w.Header())
+	}
+}
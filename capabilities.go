@@ -0,0 +1,178 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Quirks work around FastCGI applications that don't follow the spec.
+type Quirks int
+
+const (
+	// QuirkNoGetValues means the application can't handle FCGI_GET_VALUES.
+	// PHP barfs on it, for one.
+	QuirkNoGetValues Quirks = 1 << iota
+)
+
+// DefaultProbeTimeout is how long Probe waits if its context has no deadline.
+const DefaultProbeTimeout = time.Second
+
+// ErrNoGetValues is returned by Probe if the application is known not to support
+// FCGI_GET_VALUES, or turns out not to.
+var ErrNoGetValues = errors.New("Application does not support FCGI_GET_VALUES")
+
+// Capabilities are what a FastCGI application reports about itself.
+// Fields are zero if the application didn't report them.
+type Capabilities struct {
+	MaxConns    int
+	MaxRequests int
+	Multiplex   bool
+	values      map[string]string
+}
+
+// Value returns any value the application reported, including those asked for
+// beyond the standard ones.
+func (c Capabilities) Value(name string) (string, bool) {
+	v, ok := c.values[name]
+	return v, ok
+}
+
+func parseCapabilities(content []byte) (Capabilities, error) {
+	caps := Capabilities{values: make(map[string]string)}
+	reader := bytes.NewReader(content)
+	for reader.Len() > 0 {
+		name, value, err := readNameValue(reader)
+		if err != nil {
+			return caps, err
+		}
+		caps.values[name] = value
+		// Values we can't parse are left as zero.
+		n, _ := strconv.Atoi(value)
+		switch name {
+		case fcgiMaxConns:
+			caps.MaxConns = n
+		case fcgiMaxReqs:
+			caps.MaxRequests = n
+		case fcgiMpxsConns:
+			caps.Multiplex = n != 0
+		}
+	}
+	return caps, nil
+}
+
+// Probe asks the application for its capabilities over a connection of its own,
+// using FCGI_GET_VALUES. Any names beyond the standard FCGI_MAX_CONNS, FCGI_MAX_REQS
+// and FCGI_MPXS_CONNS are asked for as well. Probe does not change s.
+func (s *FCGIRequester) Probe(ctx context.Context, names ...string) (Capabilities, error) {
+	caps, _, err := s.probe(ctx, names...)
+	return caps, err
+}
+
+// probe is Probe, also reporting whether it got as far as connecting.
+func (s *FCGIRequester) probe(ctx context.Context, names ...string) (caps Capabilities, connected bool, err error) {
+	if s.Quirks&QuirkNoGetValues != 0 {
+		return caps, false, ErrNoGetValues
+	}
+	c, err := dialContext(ctx, s.dialer)
+	if err != nil {
+		return caps, false, err
+	}
+	defer c.Close()
+	if _, ok := ctx.Deadline(); !ok {
+		c.SetDeadline(time.Now().Add(DefaultProbeTimeout))
+	}
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	defer stop()
+
+	names = append([]string{fcgiMaxConns, fcgiMaxReqs, fcgiMpxsConns}, names...)
+	if err := writeGetValues(c, names...); err != nil {
+		return caps, true, err
+	}
+	for {
+		rec, err := readRecord(c)
+		if err != nil {
+			if ctx.Err() != nil {
+				return caps, true, ctx.Err()
+			}
+			return caps, true, err
+		}
+		if rec.Id != 0 {
+			continue
+		}
+		switch rec.Type {
+		case fcgiGetValuesResult:
+			caps, err = parseCapabilities(rec.Content)
+			return caps, true, err
+		case fcgiUnknown:
+			return caps, true, ErrNoGetValues
+		}
+	}
+}
+
+// How long Negotiate waits before trying again when it can't connect. The wait
+// doubles with each failure.
+const (
+	negotiateMinBackoff = time.Second
+	negotiateMaxBackoff = time.Minute
+)
+
+// Negotiate probes the application once and sizes the connection pool from
+// what it reports. Later calls return the first result without probing again,
+// unless the first could not even connect; then it is tried again after a backoff,
+// and calls meanwhile return the same error. With QuirkNoGetValues set it does
+// nothing.
+func (s *FCGIRequester) Negotiate(ctx context.Context) (Capabilities, error) {
+	if s.Quirks&QuirkNoGetValues != 0 {
+		return Capabilities{}, nil
+	}
+	s.negotiateLock.Lock()
+	defer s.negotiateLock.Unlock()
+	if s.negotiated || time.Now().Before(s.negotiateRetry) {
+		return s.caps, s.negotiateErr
+	}
+	caps, connected, err := s.probe(ctx)
+	if err != nil && ctx.Err() != nil {
+		// Not the application's fault; try again next time.
+		return caps, err
+	}
+	if err != nil && !connected {
+		// Don't add a dial to every request while the application is down.
+		backoff := negotiateMinBackoff
+		for i := 0; i < s.negotiateFailures && backoff < negotiateMaxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > negotiateMaxBackoff {
+			backoff = negotiateMaxBackoff
+		}
+		s.negotiateFailures++
+		s.negotiateRetry = time.Now().Add(backoff)
+		s.negotiateErr = err
+		return caps, err
+	}
+	s.negotiated = true
+	s.caps, s.negotiateErr = caps, err
+	if err == nil {
+		s.reqLock.Lock()
+		if caps.MaxConns > 0 {
+			s.MaxConns = caps.MaxConns
+		}
+		if caps.MaxRequests > 0 {
+			s.MaxRequests = caps.MaxRequests
+		}
+		s.CanMultiplex = caps.Multiplex
+		s.reqLock.Unlock()
+	}
+	return caps, err
+}
+
+// GetValues asks the application for its parameters and sets them. It is Negotiate
+// with DefaultProbeTimeout.
+func (s *FCGIRequester) GetValues() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultProbeTimeout)
+	defer cancel()
+	_, err := s.Negotiate(ctx)
+	return err
+}
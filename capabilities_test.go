@@ -0,0 +1,115 @@
+package gofcgisrv
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	l, err := startFCGIApp(t, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewFCGI(l.Addr().String())
+	caps, err := s.Probe(context.Background(), "NOT_A_VALUE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !caps.Multiplex {
+		t.Errorf("net/http/fcgi should multiplex")
+	}
+	if v, ok := caps.Value(fcgiMpxsConns); !ok || v != "1" {
+		t.Errorf("FCGI_MPXS_CONNS was %q", v)
+	}
+	if s.CanMultiplex {
+		t.Errorf("Probe changed the requester")
+	}
+
+	if _, err := s.Negotiate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !s.CanMultiplex {
+		t.Errorf("Negotiate did not set CanMultiplex")
+	}
+
+	s = NewFCGI(l.Addr().String())
+	s.Quirks = QuirkNoGetValues
+	if _, err := s.Probe(context.Background()); err != ErrNoGetValues {
+		t.Errorf("Probe with QuirkNoGetValues returned %v", err)
+	}
+	if _, err := s.Negotiate(context.Background()); err != nil || s.CanMultiplex {
+		t.Errorf("Negotiate with QuirkNoGetValues returned %v", err)
+	}
+}
+
+func TestNegotiateBackoff(t *testing.T) {
+	// Nobody is listening here.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	s := NewFCGI(l.Addr().String())
+	dialer := &countingDialer{Dialer: s.dialer}
+	s.dialer = dialer
+	s.AutoNegotiate = true
+
+	for i := 0; i < 5; i++ {
+		if err := s.Request(nil, strings.NewReader(""), ioutil.Discard, ioutil.Discard); err == nil {
+			t.Fatal("Request succeeded")
+		}
+	}
+	// One probe, then just the requests themselves.
+	if n := atomic.LoadInt32(&dialer.n); n != 6 {
+		t.Errorf("Dialed %d times for 5 requests", n)
+	}
+
+	// Once the backoff is over, it tries again.
+	s.negotiateLock.Lock()
+	s.negotiateRetry = time.Now()
+	s.negotiateLock.Unlock()
+	s.Request(nil, strings.NewReader(""), ioutil.Discard, ioutil.Discard)
+	if n := atomic.LoadInt32(&dialer.n); n != 8 {
+		t.Errorf("Dialed %d times after the backoff", n)
+	}
+	if s.negotiateFailures != 2 || time.Until(s.negotiateRetry) < time.Second {
+		t.Errorf("Second failure: %d failures, next try in %v", s.negotiateFailures, time.Until(s.negotiateRetry))
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	// An application that never answers anything.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+
+	s := NewFCGI(l.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := s.Probe(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Probe returned %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Probe took %v", d)
+	}
+}
@@ -1,26 +1,51 @@
 package gofcgisrv
 
 import (
+	"context"
 	"io"
 	"os/exec"
 )
 
 // A CGI server.
 type CGIRequester struct {
-	cmd  string
-	args []string
+	cmd    string
+	args   []string
+	active activeSet
 }
 
 func (cr *CGIRequester) Request(env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
-	cmd := exec.Command(cr.cmd, cr.args...)
+	return cr.RequestContext(context.Background(), env, stdin, stdout, stderr)
+}
+
+// RequestContext is like Request, but kills the child process if ctx is done before it exits.
+func (cr *CGIRequester) RequestContext(ctx context.Context, env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	done, err := cr.active.add(cancel)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	cmd := exec.CommandContext(ctx, cr.cmd, cr.args...)
 	cmd.Env = env
 	cmd.Stdin = stdin
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
-	err := cmd.Run()
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
 	return err
 }
 
+// Close kills any children still running, failing their requests with ErrClosed,
+// and makes later requests fail the same way.
+func (cr *CGIRequester) Close() error {
+	cr.active.close()
+	return nil
+}
+
 func NewCGI(cmd string, args ...string) *CGIRequester {
 	return &CGIRequester{cmd: cmd, args: args}
 }
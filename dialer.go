@@ -1,97 +1,171 @@
 package gofcgisrv
 
 import (
-	"crypto/rand"
-	"errors"
+	"context"
 	"fmt"
 	"net"
-	"os"
-	"os/exec"
-	"path"
+	"net/url"
+	"strings"
+	"sync"
 )
 
+// Dialer connects to an application.
 type Dialer interface {
 	Dial() (net.Conn, error)
 }
 
+// ContextDialer is a Dialer that can give up when a context is done.
+type ContextDialer interface {
+	Dialer
+	DialContext(ctx context.Context) (net.Conn, error)
+}
+
+// dialContext dials with d, using its DialContext method if it has one.
+// Failures are returned as DialErrors.
+func dialContext(ctx context.Context, d Dialer) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	var err error
+	if cd, ok := d.(ContextDialer); ok {
+		conn, err = cd.DialContext(ctx)
+	} else {
+		conn, err = d.Dial()
+	}
+	if err != nil {
+		return nil, &DialError{Err: err}
+	}
+	return conn, nil
+}
+
+// TCPDialer connects over TCP.
 type TCPDialer struct {
 	addr string
 }
 
+// NewTCPDialer returns a Dialer for a host:port address.
+func NewTCPDialer(addr string) TCPDialer {
+	return TCPDialer{addr: addr}
+}
+
 func (d TCPDialer) Dial() (net.Conn, error) {
 	return net.Dial("tcp", d.addr)
 }
 
-// StdinDialer managers an app as a child process, creating a socket and passing it through stdin.
-type StdinDialer struct {
-	app      string
-	args     []string
-	cmd      *exec.Cmd
-	stdin    *os.File
-	listener net.Listener
-	filename string
+func (d TCPDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	var nd net.Dialer
+	return nd.DialContext(ctx, "tcp", d.addr)
 }
 
-func (sd *StdinDialer) Dial() (net.Conn, error) {
-	if sd.stdin == nil {
-		return nil, errors.New("No file")
-	}
-	return net.Dial("unix", sd.filename)
+func (d TCPDialer) String() string {
+	return "tcp://" + d.addr
 }
 
-func (sd *StdinDialer) Start() error {
-	// Create a socket. 
-	// We'll use the high-level net API, creating a listener that does all sorts
-	// of socket stuff, getting its file, and passing that (really just for its FD)
-	// to the child process.
-	// We'll rely on crypt/rand to get a unique filename for the socket.
-	tmpdir := os.TempDir()
-	rnd := make([]byte, 8)
-	n, err := rand.Read(rnd)
-	if err != nil {
-		return err
+// UnixDialer connects over a Unix domain socket.
+type UnixDialer struct {
+	path string
+}
+
+// NewUnixDialer returns a Dialer for the Unix domain socket at path.
+func NewUnixDialer(path string) UnixDialer {
+	return UnixDialer{path: path}
+}
+
+// NewAbstractDialer returns a Dialer for a socket in the Linux abstract namespace.
+// name should not include the leading NUL (or @).
+func NewAbstractDialer(name string) UnixDialer {
+	return UnixDialer{path: "@" + name}
+}
+
+func (d UnixDialer) Dial() (net.Conn, error) {
+	return net.Dial("unix", d.path)
+}
+
+func (d UnixDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	var nd net.Dialer
+	return nd.DialContext(ctx, "unix", d.path)
+}
+
+func (d UnixDialer) String() string {
+	if strings.HasPrefix(d.path, "@") {
+		return "unix:" + d.path
 	}
-	basename := fmt.Sprintf("fcgi%x", rnd[:n])
-	filename := path.Join(tmpdir, basename)
+	return "unix://" + d.path
+}
 
-	listener, err := net.Listen("unix", filename)
-	if err != nil {
-		return err
+// ParseDialer returns a Dialer for a URL. These forms are understood:
+//
+//	tcp://127.0.0.1:9000
+//	unix:///run/php/php-fpm.sock
+//	unix:relative/path.sock
+//	unix:@abstract-name
+//
+// A plain host:port is taken to be TCP.
+func ParseDialer(rawurl string) (Dialer, error) {
+	if !strings.HasPrefix(rawurl, "tcp:") && !strings.HasPrefix(rawurl, "unix:") {
+		if _, _, err := net.SplitHostPort(rawurl); err != nil {
+			return nil, fmt.Errorf("Unknown address %q", rawurl)
+		}
+		return NewTCPDialer(rawurl), nil
 	}
-	socket, err := listener.(*net.UnixListener).File()
+	u, err := url.Parse(rawurl)
 	if err != nil {
-		listener.Close()
-		return err
+		return nil, err
 	}
-	cmd := exec.Command(sd.app, sd.args...)
-	cmd.Stdin = socket
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Start()
-	if err != nil {
-		socket.Close()
-		listener.Close()
-		return err
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("No address in %q", rawurl)
+		}
+		return NewTCPDialer(u.Host), nil
+	case "unix":
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		if path == "" || u.Host != "" {
+			return nil, fmt.Errorf("No socket path in %q", rawurl)
+		}
+		if strings.HasPrefix(path, "@") {
+			return NewAbstractDialer(path[1:]), nil
+		}
+		return NewUnixDialer(path), nil
 	}
-	sd.stdin = socket
-	sd.listener = listener
-	sd.cmd = cmd
-	sd.filename = filename
-	return nil
+	return nil, fmt.Errorf("Unknown address %q", rawurl)
 }
 
-func (sd *StdinDialer) Close() {
-	if sd.stdin != nil {
-		sd.stdin.Close()
-		sd.stdin = nil
-	}
-	if sd.listener != nil {
-		sd.listener.Close()
-		sd.listener = nil
-	}
-	if sd.cmd != nil {
-		sd.cmd.Process.Kill()
-		sd.cmd = nil
+// StdinDialer managers an app as a child process, creating a socket and passing it through stdin.
+// It is a ProcessManager with a single child, which is started by the first Dial
+// if Start hasn't been called.
+type StdinDialer struct {
+	app  string
+	args []string
+	lock sync.Mutex
+	pm   *ProcessManager
+}
+
+func (sd *StdinDialer) manager() *ProcessManager {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	if sd.pm == nil {
+		sd.pm = NewProcessManager(1, sd.app, sd.args...)
 	}
-	sd.filename = ""
+	return sd.pm
+}
+
+func (sd *StdinDialer) Dial() (net.Conn, error) {
+	return sd.manager().Dial()
+}
+
+func (sd *StdinDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	return sd.manager().DialContext(ctx)
+}
+
+func (sd *StdinDialer) Start() error {
+	return sd.manager().Start()
+}
+
+func (sd *StdinDialer) Close() {
+	sd.manager().Close()
 }
@@ -0,0 +1,76 @@
+package gofcgisrv
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseDialer(t *testing.T) {
+	data := []struct {
+		url      string
+		expected Dialer
+	}{
+		{"127.0.0.1:9000", TCPDialer{addr: "127.0.0.1:9000"}},
+		{"tcp://127.0.0.1:9000", TCPDialer{addr: "127.0.0.1:9000"}},
+		{"tcp://localhost:9000/", TCPDialer{addr: "localhost:9000"}},
+		{"unix:///run/php/php-fpm.sock", UnixDialer{path: "/run/php/php-fpm.sock"}},
+		{"unix:php.sock", UnixDialer{path: "php.sock"}},
+		{"unix:@php", UnixDialer{path: "@php"}},
+		{"unix://host/php.sock", nil},
+		{"http://127.0.0.1:9000", nil},
+		{"nonsense", nil},
+	}
+	for _, d := range data {
+		dialer, err := ParseDialer(d.url)
+		if d.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", d.url, dialer)
+			}
+			continue
+		}
+		if err != nil || dialer != d.expected {
+			t.Errorf("%s: got %v, %v", d.url, dialer, err)
+		}
+	}
+}
+
+func testUnixFCGI(t *testing.T, addr string, d Dialer) {
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fcgi.Serve(l, http.HandlerFunc(serve))
+	fcgiGet(t, NewFCGIDialer(d))
+}
+
+func TestUnixDialer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofcgisrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fcgi.sock")
+	testUnixFCGI(t, path, NewUnixDialer(path))
+
+	s, err := NewFCGIURL("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.dialer != NewUnixDialer(path) {
+		t.Errorf("Dialer was %v", s.dialer)
+	}
+}
+
+func TestAbstractDialer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Abstract sockets are Linux-only")
+	}
+	testUnixFCGI(t, "@gofcgisrv-test", NewAbstractDialer("gofcgisrv-test"))
+}
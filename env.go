@@ -0,0 +1,281 @@
+package gofcgisrv
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// EnvBuilder builds the CGI environment (RFC 3875) for an http request.
+// The zero value is usable, and is what HTTPEnv uses: the whole path becomes PATH_INFO.
+type EnvBuilder struct {
+	// DocumentRoot is the directory scripts live in. It is passed as DOCUMENT_ROOT,
+	// and SCRIPT_FILENAME and PATH_TRANSLATED are made from it.
+	DocumentRoot string
+
+	// Prefix is the URL path the application is mounted at. It is stripped from the
+	// request path before splitting, and begins SCRIPT_NAME.
+	Prefix string
+
+	// SplitPath splits the rest of the path into the script and PATH_INFO, like nginx's
+	// fastcgi_split_path_info. It must have two subexpressions, e.g. `^(.+\.php)(/.*)?$`.
+	SplitPath *regexp.Regexp
+
+	// Script, if set, is the script (relative to Prefix) for requests SplitPath doesn't
+	// match, as for a front controller like "/index.php". The whole path is then PATH_INFO.
+	Script string
+
+	// AllowHeaders, if not empty, lists the only request headers passed as HTTP_* variables.
+	// Proxy is never passed unless it is listed here.
+	AllowHeaders []string
+
+	// DenyHeaders lists request headers that are not passed.
+	DenyHeaders []string
+
+	// RejectCollisions drops headers whose variable names collide, like X-Foo and X_Foo.
+	// Otherwise the header without underscores wins.
+	RejectCollisions bool
+
+	// TLS selects the TLS variables to add beyond HTTPS.
+	TLS TLSVars
+
+	// Proxies, if set, are trusted to say where requests really came from.
+	Proxies *TrustedProxies
+}
+
+// split divides a request path into the script name and path info.
+func (b *EnvBuilder) split(path string) (prefix, script, info string) {
+	prefix = strings.TrimSuffix(b.Prefix, "/")
+	if rest := strings.TrimPrefix(path, prefix); rest != path && (rest == "" || rest[0] == '/') {
+		path = rest
+	} else {
+		prefix = ""
+	}
+	if b.SplitPath != nil {
+		if m := b.SplitPath.FindStringSubmatch(path); len(m) >= 3 {
+			return prefix, m[1], m[2]
+		}
+	}
+	if b.Script != "" {
+		return prefix, b.Script, path
+	}
+	if b.SplitPath != nil {
+		return prefix, path, ""
+	}
+	return prefix, "", path
+}
+
+// translate maps a URL path onto the document root. ok is false if the file
+// would be outside it.
+func (b *EnvBuilder) translate(path string) (name string, ok bool) {
+	name = filepath.Join(b.DocumentRoot, filepath.FromSlash(path))
+	rel, err := filepath.Rel(b.DocumentRoot, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return name, true
+}
+
+// cleanPath cleans a request path, rooted at "/", so that dot-dots can't climb
+// out of it. A trailing slash is kept.
+func cleanPath(p string) string {
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// Env returns start with the variables for r added. Variables already in start,
+// or supplied by an authorizer, are not overridden.
+func (b *EnvBuilder) Env(start []string, r *http.Request) []string {
+	envMap := make(map[string]string)
+	env := make([]string, 0, 10)
+	for _, e := range start {
+		if k, v, err := parseEnv(e); err == nil {
+			envMap[k] = v
+			env = append(env, e)
+		}
+	}
+
+	appendEnv := func(key, value string) {
+		if _, ok := envMap[key]; !ok {
+			envMap[key] = value
+			env = append(env, key+"="+value)
+		}
+	}
+
+	// Variables from an authorizer or a redirect come first.
+	for _, vars := range [][]string{AuthorizerEnv(r), RedirectEnv(r)} {
+		for _, e := range vars {
+			if k, v, err := parseEnv(e); err == nil {
+				appendEnv(k, v)
+			}
+		}
+	}
+
+	prefix, script, info := b.split(cleanPath(r.URL.Path))
+	appendEnv("SCRIPT_NAME", prefix+script)
+	if info != "" {
+		appendEnv("PATH_INFO", info)
+	}
+	if b.DocumentRoot != "" {
+		appendEnv("DOCUMENT_ROOT", b.DocumentRoot)
+		if name, ok := b.translate(script); ok && script != "" {
+			appendEnv("SCRIPT_FILENAME", name)
+		}
+		if name, ok := b.translate(info); ok && info != "" {
+			appendEnv("PATH_TRANSLATED", name)
+		}
+	}
+
+	proto := r.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	requestURI := r.RequestURI
+	if requestURI == "" {
+		requestURI = r.URL.RequestURI()
+	}
+	appendEnv("REQUEST_METHOD", r.Method)
+	appendEnv("SERVER_PROTOCOL", proto)
+	appendEnv("GATEWAY_INTERFACE", "CGI/1.1")
+	appendEnv("SERVER_SOFTWARE", "gofcgisrv")
+	appendEnv("REQUEST_URI", requestURI)
+
+	remoteAddr, remotePort, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr, remotePort = r.RemoteAddr, ""
+	}
+	https := r.TLS != nil
+	serverHost := r.Host
+	header := r.Header
+	if b.Proxies != nil {
+		if !b.Proxies.trusts(remoteAddr) {
+			header = stripProxyHeaders(header)
+		} else if client, ok := b.Proxies.client(header); ok {
+			appendEnv("REALIP_REMOTE_ADDR", remoteAddr)
+			if remotePort != "" {
+				appendEnv("REALIP_REMOTE_PORT", remotePort)
+			}
+			remoteAddr, remotePort = client.addr, client.port
+			if client.proto != "" {
+				https = client.proto == "https"
+			}
+			if client.host != "" {
+				serverHost = client.host
+			}
+		}
+	}
+	if remoteAddr != "" {
+		appendEnv("REMOTE_ADDR", remoteAddr)
+	}
+	if remotePort != "" {
+		appendEnv("REMOTE_PORT", remotePort)
+	}
+
+	host, port, err := net.SplitHostPort(serverHost)
+	if err != nil {
+		host, port = serverHost, "80"
+		if https {
+			port = "443"
+		}
+	}
+	appendEnv("SERVER_NAME", host)
+	appendEnv("SERVER_PORT", port)
+	if https {
+		appendEnv("HTTPS", "on")
+	}
+	for _, e := range tlsEnv(b.TLS, r, https) {
+		k, v, _ := parseEnv(e)
+		appendEnv(k, v)
+	}
+
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme := auth
+		if idx := strings.IndexByte(auth, ' '); idx > 0 {
+			scheme = auth[:idx]
+		}
+		// REMOTE_USER is only for users someone has checked, so it comes from an
+		// authorizer's Variable-REMOTE_USER or not at all.
+		appendEnv("AUTH_TYPE", scheme)
+	}
+
+	appendEnv("QUERY_STRING", r.URL.RawQuery)
+	if t := r.Header.Get("Content-type"); t != "" {
+		appendEnv("CONTENT_TYPE", t)
+	}
+
+	for _, e := range b.headerEnv(header) {
+		k, v, _ := parseEnv(e)
+		appendEnv(k, v)
+	}
+	return env
+}
+
+// headerVar returns the variable name for a header.
+func headerVar(name string) string {
+	return "HTTP_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// passHeader reports whether a header should be passed to the application.
+func (b *EnvBuilder) passHeader(name string) bool {
+	listed := func(list []string) bool {
+		for _, l := range list {
+			if strings.EqualFold(l, name) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(b.AllowHeaders) > 0 {
+		if !listed(b.AllowHeaders) {
+			return false
+		}
+	} else if strings.EqualFold(name, "Proxy") {
+		// httpoxy: HTTP_PROXY would be taken for the proxy to use.
+		return false
+	}
+	return !listed(b.DenyHeaders)
+}
+
+// headerEnv returns the HTTP_* variables for h, in order.
+func (b *EnvBuilder) headerEnv(h http.Header) []string {
+	names := make(map[string][]string)
+	for key := range h {
+		if b.passHeader(key) {
+			v := headerVar(key)
+			names[v] = append(names[v], key)
+		}
+	}
+	vars := make([]string, 0, len(names))
+	for v := range names {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		keys := names[v]
+		if len(keys) > 1 {
+			if b.RejectCollisions {
+				continue
+			}
+			// Prefer the header without underscores; the other is most likely spoofed.
+			sort.Slice(keys, func(i, j int) bool {
+				ui, uj := strings.Contains(keys[i], "_"), strings.Contains(keys[j], "_")
+				return !ui && uj || ui == uj && keys[i] < keys[j]
+			})
+		}
+		sep := ", "
+		if strings.EqualFold(keys[0], "Cookie") {
+			sep = "; "
+		}
+		env = append(env, v+"="+strings.Join(h[keys[0]], sep))
+	}
+	return env
+}
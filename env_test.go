@@ -0,0 +1,151 @@
+package gofcgisrv
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func envToMap(env []string) map[string]string {
+	m := make(map[string]string)
+	for _, e := range env {
+		if k, v, err := parseEnv(e); err == nil {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func TestEnvBuilder(t *testing.T) {
+	root := filepath.FromSlash("/var/www")
+	php := regexp.MustCompile(`^(.+\.php)(/.*)?$`)
+	data := []struct {
+		builder EnvBuilder
+		path    string
+		want    map[string]string
+	}{
+		{EnvBuilder{}, "/foo/bar", map[string]string{
+			"SCRIPT_NAME": "", "PATH_INFO": "/foo/bar", "SCRIPT_FILENAME": "",
+		}},
+		{EnvBuilder{DocumentRoot: root, SplitPath: php}, "/app/index.php/users/1?x=y", map[string]string{
+			"SCRIPT_NAME":     "/app/index.php",
+			"PATH_INFO":       "/users/1",
+			"SCRIPT_FILENAME": filepath.Join(root, "app", "index.php"),
+			"PATH_TRANSLATED": filepath.Join(root, "users", "1"),
+			"DOCUMENT_ROOT":   root,
+			"REQUEST_URI":     "/app/index.php/users/1?x=y",
+			"QUERY_STRING":    "x=y",
+		}},
+		{EnvBuilder{DocumentRoot: root, Prefix: "/blog/", SplitPath: php, Script: "/index.php"}, "/blog/2024/hello", map[string]string{
+			"SCRIPT_NAME":     "/blog/index.php",
+			"PATH_INFO":       "/2024/hello",
+			"SCRIPT_FILENAME": filepath.Join(root, "index.php"),
+		}},
+		{EnvBuilder{DocumentRoot: root, Prefix: "/blog", SplitPath: php}, "/blog/wp-login.php", map[string]string{
+			"SCRIPT_NAME":     "/blog/wp-login.php",
+			"PATH_INFO":       "",
+			"SCRIPT_FILENAME": filepath.Join(root, "wp-login.php"),
+			"PATH_TRANSLATED": "",
+		}},
+		// Dot-dots can't climb out of the document root.
+		{EnvBuilder{DocumentRoot: root, SplitPath: php}, "/../../tmp/evil.php", map[string]string{
+			"SCRIPT_NAME":     "/tmp/evil.php",
+			"SCRIPT_FILENAME": filepath.Join(root, "tmp", "evil.php"),
+		}},
+		{EnvBuilder{DocumentRoot: root, SplitPath: php}, "/index.php/../../../etc/passwd", map[string]string{
+			"SCRIPT_NAME":     "/etc/passwd",
+			"PATH_INFO":       "",
+			"SCRIPT_FILENAME": filepath.Join(root, "etc", "passwd"),
+			"PATH_TRANSLATED": "",
+		}},
+		{EnvBuilder{DocumentRoot: root, Script: "/index.php"}, "/index.php/../../../etc/passwd", map[string]string{
+			"SCRIPT_NAME":     "/index.php",
+			"PATH_INFO":       "/etc/passwd",
+			"PATH_TRANSLATED": filepath.Join(root, "etc", "passwd"),
+		}},
+		{EnvBuilder{DocumentRoot: root, Script: "/index.php"}, "/a/b/", map[string]string{
+			"PATH_INFO": "/a/b/",
+		}},
+		// A script configured outside the root isn't translated.
+		{EnvBuilder{DocumentRoot: root, Script: "../secret.php"}, "/x", map[string]string{
+			"SCRIPT_FILENAME": "",
+		}},
+		// Not under the prefix.
+		{EnvBuilder{Prefix: "/blog"}, "/blogger", map[string]string{
+			"SCRIPT_NAME": "", "PATH_INFO": "/blogger",
+		}},
+	}
+	for _, d := range data {
+		r := httptest.NewRequest("GET", d.path, nil)
+		env := envToMap(d.builder.Env(nil, r))
+		for k, v := range d.want {
+			if env[k] != v {
+				t.Errorf("%s: %s was %q, not %q", d.path, k, env[k], v)
+			}
+		}
+	}
+}
+
+func TestEnvRemote(t *testing.T) {
+	r := httptest.NewRequest("GET", "https://example.com/", nil)
+	r.RemoteAddr = "[::1]:4567"
+	r.SetBasicAuth("alice", "secret")
+	env := envToMap(HTTPEnv([]string{"SERVER_NAME=override"}, r))
+	want := map[string]string{
+		"REMOTE_ADDR": "::1",
+		"REMOTE_PORT": "4567",
+		"AUTH_TYPE":   "Basic",
+		"REMOTE_USER": "",
+		"HTTPS":       "on",
+		"SERVER_NAME": "override",
+		"SERVER_PORT": "443",
+	}
+	for k, v := range want {
+		if env[k] != v {
+			t.Errorf("%s was %q, not %q", k, env[k], v)
+		}
+	}
+
+	// Only an authorizer can say who the user is.
+	ctx := context.WithValue(r.Context(), authorizerEnvKey{}, []string{"REMOTE_USER=alice"})
+	env = envToMap(HTTPEnv(nil, r.WithContext(ctx)))
+	if env["REMOTE_USER"] != "alice" {
+		t.Errorf("REMOTE_USER from an authorizer was %q", env["REMOTE_USER"])
+	}
+}
+
+func TestEnvHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Add("X-Forwarded-For", "1.2.3.4")
+	r.Header.Add("X-Forwarded-For", "5.6.7.8")
+	r.Header.Add("Cookie", "a=1")
+	r.Header.Add("Cookie", "b=2")
+	r.Header.Set("Proxy", "http://evil.example.com/")
+	r.Header["X_Forwarded_For"] = []string{"spoofed"}
+	r.Header.Set("X-Secret", "s")
+
+	env := envToMap((&EnvBuilder{DenyHeaders: []string{"x-secret"}}).Env(nil, r))
+	want := map[string]string{
+		"HTTP_X_FORWARDED_FOR": "1.2.3.4, 5.6.7.8",
+		"HTTP_COOKIE":          "a=1; b=2",
+		"HTTP_PROXY":           "",
+		"HTTP_X_SECRET":        "",
+	}
+	for k, v := range want {
+		if env[k] != v {
+			t.Errorf("%s was %q, not %q", k, env[k], v)
+		}
+	}
+
+	env = envToMap((&EnvBuilder{RejectCollisions: true}).Env(nil, r))
+	if _, ok := env["HTTP_X_FORWARDED_FOR"]; ok {
+		t.Errorf("Colliding headers were passed")
+	}
+
+	env = envToMap((&EnvBuilder{AllowHeaders: []string{"Cookie", "Proxy"}}).Env(nil, r))
+	if env["HTTP_PROXY"] == "" || env["HTTP_COOKIE"] == "" || env["HTTP_X_SECRET"] != "" {
+		t.Errorf("AllowHeaders gave %v", env)
+	}
+}
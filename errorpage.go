@@ -0,0 +1,141 @@
+package gofcgisrv
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ErrorHandler writes the response for a request that failed before the application
+// sent anything. code is the status ErrorStatus chose for err.
+type ErrorHandler interface {
+	ServeError(w http.ResponseWriter, r *http.Request, code int, err error)
+}
+
+// Wrapper for functions
+type ErrorHandlerFunc func(w http.ResponseWriter, r *http.Request, code int, err error)
+
+func (f ErrorHandlerFunc) ServeError(w http.ResponseWriter, r *http.Request, code int, err error) {
+	f(w, r, code, err)
+}
+
+// DefaultErrorHandler sends the status text as plain text, and logs the error
+// with the requester's Logger, or slog.Default(). Error messages can give away
+// addresses, paths and whatever the application wrote to stderr, so they don't
+// go to the client.
+var DefaultErrorHandler ErrorHandler = ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, code int, err error) {
+	args := []any{"status", code, "error", err}
+	if r != nil {
+		args = append(args, "method", r.Method, "uri", r.RequestURI)
+	}
+	requestLogger(r).Warn("Request failed", args...)
+	http.Error(w, http.StatusText(code), code)
+})
+
+// ErrorStatus returns the http status for a failed request. Overloads and closed requesters are 503s,
+// timeouts 504s, and failures to talk to the application 502s. Missing and forbidden files,
+// as for ServeFilterFile, are 404s and 403s.
+func ErrorStatus(err error) int {
+	var netErr net.Error
+	var dial *DialError
+	var dropped *ConnectionDroppedError
+	var malformed *MalformedResponseError
+	var role *UnknownRoleError
+	var mpx *CantMultiplexError
+	switch {
+	case errors.Is(err, ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case IsOverloaded(err) || errors.Is(err, ErrClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrNoBackends) || errors.As(err, &dial) || errors.As(err, &dropped) || errors.As(err, &malformed) ||
+		errors.As(err, &role) || errors.As(err, &mpx):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// serveError sends the error response for err with opts.errors, or DefaultErrorHandler
+// if that is nil. opts.logger goes with the request, for DefaultErrorHandler.
+func serveError(w http.ResponseWriter, r *http.Request, opts responseOptions, err error) {
+	code := ErrorStatus(err)
+	if code == http.StatusServiceUnavailable {
+		// Retry-After is in whole seconds, and zero would just invite a stampede.
+		secs := int((retryAfter(err) + time.Second - 1) / time.Second)
+		if secs < 1 {
+			secs = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	if opts.logger != nil {
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, opts.logger))
+	}
+	h := opts.errors
+	if h == nil {
+		h = DefaultErrorHandler
+	}
+	h.ServeError(w, r, code, err)
+}
+
+// ErrorPages serves error responses from files, like nginx's error_page.
+type ErrorPages struct {
+	// Files maps status codes to files.
+	Files map[int]string
+	// Dir, if set, is searched for pages named for codes missing from Files,
+	// such as 502.html or 502.json.
+	Dir string
+	// Fallback handles errors with no page. If nil, DefaultErrorHandler does.
+	Fallback ErrorHandler
+}
+
+// errorPageExts are the extensions ErrorPages looks for in Dir.
+var errorPageExts = []string{".html", ".json", ".txt"}
+
+// page returns the file for code, if there is one.
+func (p *ErrorPages) page(code int) string {
+	if file, ok := p.Files[code]; ok {
+		return file
+	}
+	if p.Dir != "" {
+		for _, ext := range errorPageExts {
+			file := filepath.Join(p.Dir, strconv.Itoa(code)+ext)
+			if _, err := os.Stat(file); err == nil {
+				return file
+			}
+		}
+	}
+	return ""
+}
+
+func (p *ErrorPages) ServeError(w http.ResponseWriter, r *http.Request, code int, err error) {
+	if file := p.page(code); file != "" {
+		if body, readErr := os.ReadFile(file); readErr == nil {
+			ctype := mime.TypeByExtension(filepath.Ext(file))
+			if ctype == "" {
+				ctype = http.DetectContentType(body)
+			}
+			w.Header().Set("Content-Type", ctype)
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(code)
+			w.Write(body)
+			return
+		}
+	}
+	fallback := p.Fallback
+	if fallback == nil {
+		fallback = DefaultErrorHandler
+	}
+	fallback.ServeError(w, r, code, err)
+}
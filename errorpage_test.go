@@ -0,0 +1,182 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorStatus(t *testing.T) {
+	data := []struct {
+		err  error
+		code int
+	}{
+		{&DialError{Err: errors.New("refused")}, 502},
+		{&ConnectionDroppedError{Err: errors.New("EOF")}, 502},
+		{&MalformedResponseError{Err: errors.New("junk")}, 502},
+		{&QueueFullError{}, 503},
+		{&OverloadedError{}, 503},
+		{context.DeadlineExceeded, 504},
+		{&DialError{Err: &net.OpError{Op: "dial", Err: context.DeadlineExceeded}}, 504},
+		{ErrBodyTooLarge, 413},
+		{&fs.PathError{Op: "open", Path: "/x", Err: fs.ErrNotExist}, 404},
+		{fs.ErrPermission, 403},
+		{errors.New("something else"), 500},
+	}
+	for _, d := range data {
+		if code := ErrorStatus(d.err); code != d.code {
+			t.Errorf("%v: got %d, not %d", d.err, code, d.code)
+		}
+	}
+}
+
+// serveAborted serves a request with h, reporting whether it was aborted.
+func serveAborted(h http.Handler, w http.ResponseWriter, r *http.Request) (aborted bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			aborted = true
+		}
+	}()
+	h.ServeHTTP(w, r)
+	return false
+}
+
+func TestServeErrors(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		switch req.params["REQUEST_URI"] {
+		case "/junk":
+			return fakeResponse{stdout: "This is not a header\r\n\r\n"}
+		case "/late":
+			// The response has gone out by the time this fails.
+			return fakeResponse{stdout: "\r\nhello", appStatus: 1}
+		case "/dropped-headers":
+			return fakeResponse{stdout: "Set-Cookie: a=b\r\nContent-Encoding: gzip\r\nLocation: http://evil/\r\n\r\npartial", drop: true}
+		case "/dropped":
+			return fakeResponse{stdout: "\r\npartial", drop: true}
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+		return fakeResponse{stdout: "\r\nok"}
+	})
+	defer app.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "502.html"), []byte("<h1>Bad gateway</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pages := &ErrorPages{Dir: dir}
+
+	s := NewFCGI(app.Addr())
+	s.ErrorHandler = pages
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/junk", nil))
+	if w.Code != 502 || w.Body.String() != "<h1>Bad gateway</h1>" || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Malformed response got %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	// A failure reported after the output, streamed or not, leaves the response be.
+	logs := bytes.NewBuffer(nil)
+	s.Logger = slog.New(slog.NewJSONHandler(logs, nil))
+	for _, flush := range []FlushPolicy{FlushEveryRecord, FlushBuffered} {
+		s.Flush = flush
+		w = httptest.NewRecorder()
+		if serveAborted(s, w, httptest.NewRequest("GET", "/late", nil)) || w.Code != 200 || w.Body.String() != "hello" {
+			t.Errorf("Late failure with flush %d got %d %q", flush, w.Code, w.Body.String())
+		}
+	}
+	if recs := logRecords(t, logs); len(recs) != 2 || !strings.Contains(recs[0]["error"].(string), "status 1") {
+		t.Errorf("Late failures logged as %v", recs)
+	}
+	s.Flush = FlushEveryRecord
+
+	// Once output has been sent, a dropped connection can only cut it off.
+	w = httptest.NewRecorder()
+	if !serveAborted(s, w, httptest.NewRequest("GET", "/dropped", nil)) || w.Code != 200 || w.Body.String() != "partial" {
+		t.Errorf("Dropped connection got %d %q", w.Code, w.Body.String())
+	}
+
+	// If it was held back, none of the application's headers go with the error.
+	s.Flush = FlushBuffered
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/dropped-headers", nil))
+	if w.Code != 502 || w.Header().Get("Set-Cookie") != "" || w.Header().Get("Content-Encoding") != "" || w.Header().Get("Location") != "" {
+		t.Errorf("Failed buffered response got %d %v", w.Code, w.Header())
+	}
+	s.Flush = FlushEveryRecord
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil).WithContext(ctx))
+	if w.Code != 504 {
+		t.Errorf("Timeout got %d", w.Code)
+	}
+
+	// Nobody is listening here any more.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	s = NewFCGI(l.Addr().String())
+	s.ErrorHandler = pages
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 502 || w.Body.String() != "<h1>Bad gateway</h1>" {
+		t.Errorf("Dial failure got %d %q", w.Code, w.Body.String())
+	}
+
+	// Pages can be missing.
+	w = httptest.NewRecorder()
+	pages.ServeError(w, nil, 504, context.DeadlineExceeded)
+	if w.Code != 504 || w.Body.String() != "Gateway Timeout\n" {
+		t.Errorf("Fallback got %d %q", w.Code, w.Body.String())
+	}
+
+	// Authorizers and filters fail the same way, without giving anything away.
+	w = httptest.NewRecorder()
+	AuthorizerHandler(s, nil, http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 502 || w.Body.String() != "Bad Gateway\n" {
+		t.Errorf("Authorizer dial failure got %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	ServeFilterFile(s, nil, filepath.Join(dir, "missing.html"), w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 404 || w.Body.String() != "Not Found\n" {
+		t.Errorf("Missing filter file got %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	ServeFilterFile(s, nil, dir, w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 403 || w.Body.String() != "Forbidden\n" {
+		t.Errorf("Filter directory got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestDefaultErrorHandlerLogger(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	s := NewFCGI(l.Addr().String())
+	logs := bytes.NewBuffer(nil)
+	s.Logger = slog.New(slog.NewJSONHandler(logs, nil))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+	recs := logRecords(t, logs)
+	if w.Code != 502 || len(recs) != 1 || recs[0]["msg"] != "Request failed" || recs[0]["uri"] != "/page" {
+		t.Errorf("Failure got %d, logged as %v", w.Code, recs)
+	}
+}
@@ -0,0 +1,116 @@
+package gofcgisrv
+
+import (
+	"fmt"
+)
+
+// The errors here are returned by FCGIRequester when a request does not complete
+// normally. Use errors.As to tell them apart.
+
+// OverloadedError means the application rejected the request because it is too busy
+// (FCGI_OVERLOADED).
+type OverloadedError struct {
+	AppStatus uint32
+}
+
+func (e *OverloadedError) Error() string {
+	return "FastCGI application is overloaded"
+}
+
+// UnknownRoleError means the application does not support the role the request asked for
+// (FCGI_UNKNOWN_ROLE).
+type UnknownRoleError struct {
+	Role uint16
+}
+
+func (e *UnknownRoleError) Error() string {
+	return fmt.Sprintf("FastCGI application does not support role %d", e.Role)
+}
+
+// CantMultiplexError means the application rejected a request on a connection that
+// was already in use (FCGI_CANT_MPX_CONN).
+type CantMultiplexError struct{}
+
+func (e *CantMultiplexError) Error() string {
+	return "FastCGI application cannot multiplex connections"
+}
+
+// AppStatusError means the application completed the request but reported a non-zero
+// exit status.
+type AppStatusError struct {
+	AppStatus uint32
+}
+
+func (e *AppStatusError) Error() string {
+	return fmt.Sprintf("FastCGI application exited with status %d", e.AppStatus)
+}
+
+// ConnectionDroppedError means the connection to the application was lost before
+// the request ended. Any output may be incomplete.
+type ConnectionDroppedError struct {
+	Err error
+}
+
+func (e *ConnectionDroppedError) Error() string {
+	return fmt.Sprintf("FastCGI connection closed before END_REQUEST: %v", e.Err)
+}
+
+func (e *ConnectionDroppedError) Unwrap() error {
+	return e.Err
+}
+
+// SlowClientError means a request's output couldn't be passed on as fast as the
+// application sent it, and more than Limit bytes of it built up, on a connection
+// shared with other requests. The request is aborted and its output is incomplete.
+type SlowClientError struct {
+	Limit int
+}
+
+func (e *SlowClientError) Error() string {
+	return fmt.Sprintf("Client fell more than %d bytes behind the application", e.Limit)
+}
+
+// endRequestError converts the body of an END_REQUEST record into an error.
+func endRequestError(role uint16, appStatus uint32, protocolStatus uint8) error {
+	switch protocolStatus {
+	case fcgiRequestComplete:
+		if appStatus != 0 {
+			return &AppStatusError{AppStatus: appStatus}
+		}
+		return nil
+	case fcgiCantMpxConn:
+		return &CantMultiplexError{}
+	case fcgiOverloaded:
+		return &OverloadedError{AppStatus: appStatus}
+	case fcgiUnknownRole:
+		return &UnknownRoleError{Role: role}
+	}
+	return fmt.Errorf("Unknown FastCGI protocol status %d", protocolStatus)
+}
+
+// MalformedResponseError means the application's output didn't start with a valid
+// CGI header block.
+type MalformedResponseError struct {
+	Err error
+}
+
+func (e *MalformedResponseError) Error() string {
+	return fmt.Sprintf("Malformed CGI response: %v", e.Err)
+}
+
+func (e *MalformedResponseError) Unwrap() error {
+	return e.Err
+}
+
+// DialError means the application couldn't be connected to.
+type DialError struct {
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("Can't connect to application: %v", e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
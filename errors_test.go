@@ -0,0 +1,86 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestEndRequestErrors(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		switch req.params["RESULT"] {
+		case "overloaded":
+			return fakeResponse{protocolStatus: fcgiOverloaded}
+		case "role":
+			return fakeResponse{protocolStatus: fcgiUnknownRole}
+		case "mpx":
+			return fakeResponse{protocolStatus: fcgiCantMpxConn}
+		case "crash":
+			return fakeResponse{stdout: "\r\nPartial", appStatus: 255}
+		}
+		return fakeResponse{stdout: "\r\nFine"}
+	})
+	defer app.Close()
+	s := NewFCGI(app.Addr())
+
+	request := func(result string) error {
+		var stdout, stderr bytes.Buffer
+		return s.Request([]string{"RESULT=" + result}, strings.NewReader(""), &stdout, &stderr)
+	}
+
+	if err := request("ok"); err != nil {
+		t.Errorf("Successful request returned %v", err)
+	}
+	var overloaded *OverloadedError
+	if err := request("overloaded"); !errors.As(err, &overloaded) {
+		t.Errorf("Overloaded request returned %v", err)
+	}
+	var unknownRole *UnknownRoleError
+	if err := request("role"); !errors.As(err, &unknownRole) || unknownRole.Role != fcgiResponder {
+		t.Errorf("Unknown role request returned %v", err)
+	}
+	var cantMpx *CantMultiplexError
+	if err := request("mpx"); !errors.As(err, &cantMpx) {
+		t.Errorf("Unmultiplexed request returned %v", err)
+	}
+	var appStatus *AppStatusError
+	if err := request("crash"); !errors.As(err, &appStatus) || appStatus.AppStatus != 255 {
+		t.Errorf("Crashed request returned %v", err)
+	}
+}
+
+func TestConnectionDropped(t *testing.T) {
+	// An application that hangs up after reading the request.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					rec, err := readRecord(c)
+					if err != nil || (rec.Type == fcgiStdin && len(rec.Content) == 0) {
+						break
+					}
+				}
+				c.Close()
+			}()
+		}
+	}()
+
+	s := NewFCGI(l.Addr().String())
+	var stdout, stderr bytes.Buffer
+	err = s.Request(nil, strings.NewReader("body"), &stdout, &stderr)
+	var dropped *ConnectionDroppedError
+	if !errors.As(err, &dropped) {
+		t.Errorf("Dropped request returned %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeRequest is a request as seen by fakeApp.
+type fakeRequest struct {
+	role   uint16
+	flags  byte
+	params map[string]string
+	stdin  bytes.Buffer
+	data   bytes.Buffer
+
+	paramBuf  bytes.Buffer
+	gotParams bool
+	gotStdin  bool
+}
+
+type fakeResponse struct {
+	stdout         string
+	stderr         string
+	appStatus      uint32
+	protocolStatus uint8
+	// drop closes the connection after sending stdout, without ending the request.
+	drop bool
+}
+
+// fakeApp is a minimal FastCGI application that supports every role,
+// multiplexing and aborts. Each request's handler runs in its own goroutine.
+type fakeApp struct {
+	l       net.Listener
+	handler func(*fakeRequest) fakeResponse
+}
+
+func startFakeApp(t *testing.T, handler func(*fakeRequest) fakeResponse) *fakeApp {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &fakeApp{l: l, handler: handler}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go app.serveConn(c)
+		}
+	}()
+	return app
+}
+
+func (app *fakeApp) Addr() string {
+	return app.l.Addr().String()
+}
+
+func (app *fakeApp) Close() error {
+	return app.l.Close()
+}
+
+func (app *fakeApp) serveConn(c net.Conn) {
+	defer c.Close()
+	var lock sync.Mutex
+	reqs := make(map[requestId]*fakeRequest)
+	running := make(map[requestId]bool)
+	endRequest := func(id requestId, appStatus uint32, protocolStatus uint8) {
+		var body [8]byte
+		binary.BigEndian.PutUint32(body[:], appStatus)
+		body[4] = protocolStatus
+		writeRecord(c, record{fcgiEndRequest, id, body[:]})
+	}
+	for {
+		rec, err := readRecord(c)
+		if err != nil {
+			return
+		}
+		if rec.Id == 0 {
+			continue
+		}
+		if rec.Type == fcgiBeginRequest {
+			reqs[rec.Id] = &fakeRequest{
+				role:   binary.BigEndian.Uint16(rec.Content),
+				flags:  rec.Content[2],
+				params: make(map[string]string),
+			}
+			continue
+		}
+		if rec.Type == fcgiAbortRequest {
+			lock.Lock()
+			if _, ok := reqs[rec.Id]; ok || running[rec.Id] {
+				delete(reqs, rec.Id)
+				delete(running, rec.Id)
+				endRequest(rec.Id, 1, fcgiRequestComplete)
+			}
+			lock.Unlock()
+			continue
+		}
+		req := reqs[rec.Id]
+		if req == nil {
+			continue
+		}
+		switch rec.Type {
+		case fcgiParams:
+			if len(rec.Content) > 0 {
+				req.paramBuf.Write(rec.Content)
+				continue
+			}
+			for req.paramBuf.Len() > 0 {
+				name, value, err := readNameValue(&req.paramBuf)
+				if err != nil {
+					break
+				}
+				req.params[name] = value
+			}
+			req.gotParams = true
+		case fcgiStdin:
+			req.stdin.Write(rec.Content)
+			req.gotStdin = len(rec.Content) == 0
+		case fcgiData:
+			req.data.Write(rec.Content)
+		}
+		// Filters wait for the end of the data stream.
+		finished := req.gotParams && req.gotStdin
+		if req.role == fcgiFilter {
+			finished = finished && rec.Type == fcgiData && len(rec.Content) == 0
+		}
+		if !finished {
+			continue
+		}
+		lock.Lock()
+		delete(reqs, rec.Id)
+		running[rec.Id] = true
+		lock.Unlock()
+		id := rec.Id
+		go func() {
+			resp := app.handler(req)
+			lock.Lock()
+			defer lock.Unlock()
+			if !running[id] {
+				// Aborted
+				return
+			}
+			delete(running, id)
+			stdout := newStreamWriter(c, fcgiStdout, id)
+			stdout.Write([]byte(resp.stdout))
+			if resp.drop {
+				c.Close()
+				return
+			}
+			stdout.Close()
+			if resp.stderr != "" {
+				stderr := newStreamWriter(c, fcgiStderr, id)
+				stderr.Write([]byte(resp.stderr))
+				stderr.Close()
+			}
+			endRequest(id, resp.appStatus, resp.protocolStatus)
+			if req.flags&fcgiKeepConn == 0 {
+				c.Close()
+			}
+		}()
+	}
+}
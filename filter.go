@@ -0,0 +1,70 @@
+package gofcgisrv
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Filterer is the interface for anything that can run a FastCGI Filter request.
+// FCGIRequester is one.
+type Filterer interface {
+	Filter(env []string, stdin io.Reader, data io.Reader, stdout io.Writer, stderr io.Writer) error
+}
+
+// Wrapper for functions
+type FilterFunc func(env []string, stdin io.Reader, data io.Reader, stdout io.Writer, stderr io.Writer) error
+
+func (f FilterFunc) Filter(env []string, stdin io.Reader, data io.Reader, stdout io.Writer, stderr io.Writer) error {
+	return f(env, stdin, data, stdout, stderr)
+}
+
+// FilterEnv adds the variables describing a filter's data stream to env.
+// length is the number of bytes of data, and modtime when it was last modified.
+func FilterEnv(env []string, length int64, modtime time.Time) []string {
+	return append(env,
+		fcgiDataLastMod+"="+strconv.FormatInt(modtime.Unix(), 10),
+		fcgiDataLength+"="+strconv.FormatInt(length, 10),
+	)
+}
+
+// ServeFilter serves an http request by passing data through a filter application.
+// length must be the exact length of data. The filter's output is processed just
+// as a Responder's would be, except that local redirects go to the client.
+func ServeFilter(f Filterer, env []string, data io.Reader, length int64, modtime time.Time, w http.ResponseWriter, r *http.Request) {
+	env = HTTPEnv(env, r)
+	env, body, cleanup, err := requestBody(env, r, DefaultSpool)
+	if err != nil {
+		serveError(w, r, responseOptions{}, err)
+		return
+	}
+	defer cleanup()
+	env = FilterEnv(env, length, modtime)
+	serveResponse(w, r, responseOptions{}, func(stdout, stderr io.Writer) error {
+		return f.Filter(env, body, data, stdout, stderr)
+	})
+}
+
+// ServeFilterFile serves an http request by passing the named file through a filter application.
+func ServeFilterFile(f Filterer, env []string, filename string, w http.ResponseWriter, r *http.Request) {
+	file, err := os.Open(filename)
+	if err != nil {
+		serveError(w, r, responseOptions{}, err)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		serveError(w, r, responseOptions{}, err)
+		return
+	}
+	if info.IsDir() {
+		serveError(w, r, responseOptions{}, fmt.Errorf("%s is a directory: %w", filename, fs.ErrPermission))
+		return
+	}
+	ServeFilter(f, env, file, info.Size(), info.ModTime(), w, r)
+}
@@ -0,0 +1,63 @@
+package gofcgisrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFCGIFilter(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		if req.role != fcgiFilter {
+			return fakeResponse{protocolStatus: fcgiUnknownRole}
+		}
+		if req.params[fcgiDataLength] != strconv.Itoa(req.data.Len()) {
+			t.Errorf("FCGI_DATA_LENGTH was %s for %d bytes", req.params[fcgiDataLength], req.data.Len())
+		}
+		return fakeResponse{stdout: "Content-Type: text/plain\r\nX-Last-Mod: " + req.params[fcgiDataLastMod] + "\r\n\r\n" +
+			strings.ToUpper(req.data.String())}
+	})
+	defer app.Close()
+
+	dir, err := ioutil.TempDir("", "gofcgisrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Bigger than a single record.
+	text := strings.Repeat("filter me ", 10000)
+	filename := filepath.Join(dir, "page.txt")
+	if err := ioutil.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modtime := time.Unix(1234567890, 0)
+	os.Chtimes(filename, modtime, modtime)
+
+	s := NewFCGI(app.Addr())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeFilterFile(s, nil, filename, w, r)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/page.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("Status was %d", resp.StatusCode)
+	}
+	if string(body) != strings.ToUpper(text) {
+		t.Errorf("Filtered output was wrong (%d bytes)", len(body))
+	}
+	if lm := resp.Header.Get("X-Last-Mod"); lm != "1234567890" {
+		t.Errorf("FCGI_DATA_LAST_MOD was %s", lm)
+	}
+}
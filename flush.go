@@ -0,0 +1,64 @@
+package gofcgisrv
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// FlushPolicy says when a response is flushed to the client as the application produces it.
+// An application can override the policy for a response with an X-Accel-Buffering header:
+// "no" flushes every record, and "yes" buffers up to the flush size.
+type FlushPolicy int
+
+const (
+	// FlushEveryRecord flushes whenever the application sends output.
+	FlushEveryRecord FlushPolicy = iota
+	// FlushThreshold flushes once the flush size has built up.
+	FlushThreshold
+	// FlushBuffered holds the whole response until the application is done.
+	FlushBuffered
+)
+
+// DefaultFlushSize is used by FlushThreshold if no size is given.
+const DefaultFlushSize = 32 * 1024
+
+// bufferingOverride applies an application's X-Accel-Buffering header to policy.
+func bufferingOverride(hdr textproto.MIMEHeader, policy FlushPolicy) FlushPolicy {
+	switch strings.ToLower(strings.TrimSpace(hdr.Get("X-Accel-Buffering"))) {
+	case "no":
+		return FlushEveryRecord
+	case "yes":
+		if policy == FlushEveryRecord {
+			return FlushThreshold
+		}
+	}
+	return policy
+}
+
+// flushWriter flushes an http.ResponseWriter according to a policy.
+type flushWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	policy  FlushPolicy
+	size    int
+	pending int
+}
+
+func newFlushWriter(w http.ResponseWriter, policy FlushPolicy, size int) *flushWriter {
+	if size <= 0 {
+		size = DefaultFlushSize
+	}
+	flusher, _ := w.(http.Flusher)
+	return &flushWriter{w: w, flusher: flusher, policy: policy, size: size}
+}
+
+func (fw *flushWriter) Write(data []byte) (int, error) {
+	n, err := fw.w.Write(data)
+	fw.pending += n
+	if fw.flusher != nil && (fw.policy == FlushEveryRecord || fw.pending >= fw.size) {
+		fw.flusher.Flush()
+		fw.pending = 0
+	}
+	return n, err
+}
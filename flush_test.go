@@ -0,0 +1,100 @@
+package gofcgisrv
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamingResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	proceed := make(chan struct{})
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-proceed
+		io.WriteString(w, "data: second\n\n")
+	}))
+
+	s := NewFCGI(l.Addr().String())
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := make(chan string)
+	go func() {
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+	select {
+	case line := <-lines:
+		if line != "data: first\n" {
+			t.Errorf("First line was %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The first event was not streamed")
+	}
+	close(proceed)
+	for range lines {
+	}
+}
+
+func TestFlushBuffered(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		if req.params["REQUEST_URI"] == "/stream" {
+			return fakeResponse{stdout: "X-Accel-Buffering: no\r\n\r\nstreamed"}
+		}
+		return fakeResponse{stdout: "\r\nbuffered"}
+	})
+	defer app.Close()
+
+	s := NewFCGI(app.Addr())
+	s.Flush = FlushBuffered
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "buffered" || resp.ContentLength != int64(len("buffered")) {
+		t.Errorf("Buffered response was %q, length %d", body, resp.ContentLength)
+	}
+
+	resp, err = http.Get(server.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "streamed" || resp.ContentLength != -1 {
+		t.Errorf("Streamed response was %q, length %d", body, resp.ContentLength)
+	}
+	if resp.Header.Get("X-Accel-Buffering") != "" {
+		t.Errorf("X-Accel-Buffering was passed on to the client")
+	}
+}
@@ -9,19 +9,19 @@ package gofcgisrv
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var logger *log.Logger = log.New(os.Stderr, "", 0)
-
 // Requester is the interface for any CGI-like protocol server.
 type Requester interface {
 	Request(env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error
@@ -34,6 +34,40 @@ func (f RequesterFunc) Request(env []string, stdin io.Reader, stdout io.Writer,
 	return f(env, stdin, stdout, stderr)
 }
 
+// ContextRequester is a Requester whose requests can be cancelled.
+type ContextRequester interface {
+	Requester
+	RequestContext(ctx context.Context, env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error
+}
+
+// RequestContext executes a request with s. If s is a ContextRequester the request
+// is abandoned when ctx is done; otherwise ctx is only checked before starting.
+func RequestContext(ctx context.Context, s Requester, env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	if cr, ok := s.(ContextRequester); ok {
+		return cr.RequestContext(ctx, env, stdin, stdout, stderr)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Request(env, stdin, stdout, stderr)
+}
+
+// WithContext adapts any Requester to a ContextRequester; see RequestContext.
+func WithContext(s Requester) ContextRequester {
+	if cr, ok := s.(ContextRequester); ok {
+		return cr
+	}
+	return contextAdapter{s}
+}
+
+type contextAdapter struct {
+	Requester
+}
+
+func (ca contextAdapter) RequestContext(ctx context.Context, env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	return RequestContext(ctx, ca.Requester, env, stdin, stdout, stderr)
+}
+
 // Server is the external interface. It manages connections to a single FastCGI application.
 // A server may maintain many connections, each of which may multiplex many requests.
 type FCGIRequester struct {
@@ -42,196 +76,581 @@ type FCGIRequester struct {
 	reqLock     sync.Mutex
 	reqCond     *sync.Cond
 	initialized bool
+	closing     bool // set by Shutdown or Close
+	// Requests holding a slot but not yet on a connection, because they are
+	// dialing one (which is done without reqLock) or waiting for one being dialed.
+	reserved int
+	dialing  map[*pendingDial]bool
+
+	queue    []*waiter
+	queueSeq uint64
+	stats    RequesterStats
+
+	negotiateLock sync.Mutex
+	negotiated    bool
+	caps          Capabilities
+	negotiateErr  error
+	// After failing to connect, Negotiate doesn't try again until negotiateRetry.
+	negotiateFailures int
+	negotiateRetry    time.Time
 
 	// Parameters of the application
 	CanMultiplex bool
 	MaxConns     int
 	MaxRequests  int
+
+	// KeepConns asks the application to keep connections open (FCGI_KEEP_CONN)
+	// so they can be reused for later requests. Multiplexed connections are
+	// always kept open.
+	KeepConns bool
+	// IdleTimeout, if nonzero, is how long a kept connection may sit idle
+	// before it is closed.
+	IdleTimeout time.Duration
+	// MaxConnLifetime, if nonzero, is how long a kept connection may be used
+	// before it is retired.
+	MaxConnLifetime time.Duration
+
+	// AutoNegotiate has the first request call Negotiate, so that the parameters
+	// above come from the application.
+	AutoNegotiate bool
+	// Quirks work around applications that don't follow the spec.
+	Quirks Quirks
+
+	// MaxQueue, if nonzero, is how many requests may wait for a free slot
+	// before more are turned away with QueueFullError.
+	MaxQueue int
+	// QueueTimeout, if nonzero, is how long a request may wait for a free slot
+	// before giving up with QueueTimeoutError.
+	QueueTimeout time.Duration
+	// RetryAfter is what ServeHTTP tells clients turned away by the queue.
+	RetryAfter time.Duration
+
+	// Flush says when ServeHTTP sends the application's output on to the client.
+	// FlushSize is the threshold for FlushThreshold.
+	Flush     FlushPolicy
+	FlushSize int
+
+	// Env builds the environment for ServeHTTP. If nil, HTTPEnv is used.
+	Env *EnvBuilder
+
+	// LocalRedirect serves the local redirects an application asks for.
+	// If nil, they are served by the requester itself.
+	LocalRedirect http.Handler
+
+	// ErrorHandler sends the response when a request fails. If nil, DefaultErrorHandler does.
+	ErrorHandler ErrorHandler
+
+	// Spool says how ServeHTTP holds request bodies of unknown length.
+	Spool SpoolPolicy
+
+	// AbortTimeout is how long a cancelled request waits for the application to
+	// answer FCGI_ABORT_REQUEST before its connection is closed. Zero means
+	// DefaultAbortTimeout.
+	AbortTimeout time.Duration
+
+	// Timeouts limit each phase of a request.
+	Timeouts Timeouts
+
+	// Logger gets the application's error output from ServeHTTP, failed requests
+	// (from DefaultErrorHandler), and anything else worth reporting. If nil,
+	// slog.Default() is used.
+	Logger *slog.Logger
+	// Stderr says what ServeHTTP does with the application's error output.
+	Stderr StderrPolicy
 }
 
+// DefaultAbortTimeout is the AbortTimeout used if none is set.
+const DefaultAbortTimeout = 5 * time.Second
+
 // NewServer creates a server that will attempt to connect to the application at the given address over TCP.
 func NewFCGI(applicationAddr string) *FCGIRequester {
+	return NewFCGIDialer(TCPDialer{addr: applicationAddr})
+}
+
+// NewFCGIDialer creates a server that connects to the application with d.
+func NewFCGIDialer(d Dialer) *FCGIRequester {
 	s := &FCGIRequester{}
-	s.dialer = TCPDialer{addr: applicationAddr}
+	s.dialer = d
 	s.MaxConns = 1
 	s.MaxRequests = 1
 	s.reqCond = sync.NewCond(&s.reqLock)
 	return s
 }
 
+// NewFCGIURL creates a server that connects to the application at a URL such as
+// unix:///run/php/php-fpm.sock or tcp://127.0.0.1:9000. See ParseDialer.
+func NewFCGIURL(rawurl string) (*FCGIRequester, error) {
+	d, err := ParseDialer(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return NewFCGIDialer(d), nil
+}
+
 // NewFCGIStdin creates a server that runs the app and connects over stdin.
 func NewFCGIStdin(app string, args ...string) *FCGIRequester {
-	s := &FCGIRequester{}
-	s.dialer = &StdinDialer{app: app, args: args}
-	s.MaxConns = 1
-	s.MaxRequests = 1
-	s.reqCond = sync.NewCond(&s.reqLock)
-	return s
+	return NewFCGIDialer(&StdinDialer{app: app, args: args})
 }
 
-func (s *FCGIRequester) processGetValuesResult(rec record) (int, error) {
-	nproc := 0
-	switch rec.Type {
-	case fcgiGetValuesResult:
-		reader := bytes.NewReader(rec.Content)
-		for {
-			name, value, err := readNameValue(reader)
-			if err != nil {
-				return nproc, err
-			}
-			val, err := strconv.ParseInt(value, 10, 32)
-			if err != nil {
-				return nproc, err
-			}
-			nproc++
-			switch name {
-			case fcgiMaxConns:
-				s.MaxConns = int(val)
-			case fcgiMaxReqs:
-				s.MaxRequests = int(val)
-			case fcgiMpxsConns:
-				s.CanMultiplex = (val != 0)
-			}
-		}
-	}
-	return nproc, nil
+// Request executes a request using env and stdin as inputs and stdout and stderr as outputs.
+// env should be a slice of name=value pairs. It blocks until the application has finished.
+func (s *FCGIRequester) Request(env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	return s.roleRequest(context.Background(), fcgiResponder, env, stdin, nil, stdout, stderr)
 }
 
-// PHP barfs on FCGI_GET_VALUES. I don't know why. Maybe it expects a different connection.
-// For now don't do it unless asked.
-func (s *FCGIRequester) GetValues() error {
-	c, err := s.dialer.Dial()
-	time.AfterFunc(time.Second, func() { c.Close() })
-	if err != nil {
-		return err
+// RequestContext is like Request, but if ctx is done before the application
+// has finished, the request is aborted and ctx's error (or cause) is returned.
+func (s *FCGIRequester) RequestContext(ctx context.Context, env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	return s.roleRequest(ctx, fcgiResponder, env, stdin, nil, stdout, stderr)
+}
+
+// Authorize executes an Authorizer request using env as input. No stdin is sent.
+// The application's response, including any Variable-* headers, is written to stdout.
+func (s *FCGIRequester) Authorize(env []string, stdout io.Writer, stderr io.Writer) error {
+	return s.roleRequest(context.Background(), fcgiAuthorizer, env, strings.NewReader(""), nil, stdout, stderr)
+}
+
+// Filter executes a Filter request. It is like Request, but data is sent to the
+// application as the FCGI_DATA stream once stdin is done. env should include
+// FCGI_DATA_LAST_MOD and FCGI_DATA_LENGTH; see FilterEnv.
+func (s *FCGIRequester) Filter(env []string, stdin io.Reader, data io.Reader, stdout io.Writer, stderr io.Writer) error {
+	return s.roleRequest(context.Background(), fcgiFilter, env, stdin, data, stdout, stderr)
+}
+
+// roleRequest executes a request in the given FastCGI role. data is only sent
+// for filters.
+func (s *FCGIRequester) roleRequest(ctx context.Context, role uint16, env []string, stdin io.Reader, data io.Reader, stdout io.Writer, stderr io.Writer) error {
+	// Timeouts cancel the request, saying why.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer cancelAfter(cancel, s.Timeouts.Total, &TotalTimeoutError{Limit: s.Timeouts.Total})()
+
+	if s.AutoNegotiate {
+		// If the application can't tell us, we just use what we have.
+		s.Negotiate(ctx)
 	}
-	//	  time.AfterFunc(time.Second, func() { c.Close()})
-	writeGetValues(c, fcgiMpxsConns, fcgiMaxReqs, fcgiMaxConns)
-	n := 0
-	for n < 3 {
-		rec, err := readRecord(c)
+
+	// A kept connection may have been closed by the application while it sat
+	// idle, in which case the request fails before the application has seen it.
+	// It can be sent once more on a new connection, if we still have the input.
+	// But a connection dropped later may have been dropped by an application that
+	// ran the request and then crashed, so only idempotent requests are sent again
+	// then.
+	in := &replayReader{r: stdin}
+	fresh := false
+	for {
+		// Get a request. We may have to wait for one to free up.
+		r, err := s.newRequest(ctx, cancel, role, fresh, stdout, stderr)
 		if err != nil {
-			return nil
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return err
 		}
-		np, _ := s.processGetValuesResult(rec)
-		n += np
+		err = s.sendRequest(ctx, cancel, r, env, in, data)
+		var dropped *ConnectionDroppedError
+		if !r.reused || fresh || role == fcgiFilter || !errors.As(err, &dropped) ||
+			atomic.LoadInt32(&r.gotOutput) != 0 || !(r.unsent || idempotent(env)) || !in.rewind() {
+			return err
+		}
+		fresh = true
 	}
-	c.Close()
-	return nil
 }
 
-// Request executes a request using env and stdin as inputs and stdout and stderr as outputs.
-// env should be a slice of name=value pairs. It blocks until the application has finished.
-func (s *FCGIRequester) Request(env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
-	// Get a request. We may have to wait for one to free up.
-	r, err := s.newRequest()
-	if err != nil {
-		return err
+// sendRequest sends a request and waits for it to end.
+func (s *FCGIRequester) sendRequest(ctx context.Context, cancel context.CancelCauseFunc, r *request, env []string, stdin io.Reader, data io.Reader) error {
+	role := r.role
+	stop := context.AfterFunc(ctx, func() {
+		r.out.discard()
+		s.abortRequest(r)
+	})
+	stopSend := cancelAfter(cancel, s.Timeouts.Send, &SendTimeoutError{Limit: s.Timeouts.Send})
+	// A write the application isn't reading holds up abortRequest, which needs the
+	// write lock. On a connection of its own, it can be given a deadline instead.
+	deadline := r.alone && s.Timeouts.Send > 0
+	if deadline {
+		r.conn.netconn.SetWriteDeadline(time.Now().Add(s.Timeouts.Send))
 	}
 
 	// Send BeginRequest.
-	writeBeginRequest(r.conn.netconn, r.id, fcgiResponder, 0)
+	var flags byte
+	if r.conn.keepConn {
+		flags |= fcgiKeepConn
+	}
+	failed := writeBeginRequest(r.conn, r.id, role, flags) != nil
 
 	// Send the environment.
-	params := newStreamWriter(r.conn.netconn, fcgiParams, r.id)
+	params := newStreamWriter(r.conn, fcgiParams, r.id)
 	for _, envstring := range env {
 		splits := strings.SplitN(envstring, "=", 2)
 		if len(splits) == 2 {
-			writeNameValue(params, splits[0], splits[1])
+			failed = writeNameValue(params, splits[0], splits[1]) != nil || failed
 		}
 	}
-	params.Close()
+	failed = params.Close() != nil || failed
+	// If that failed, or the connection had already been dropped, the application
+	// can't have had the whole request.
+	select {
+	case <-r.done:
+		r.unsent = true
+	default:
+		r.unsent = failed
+	}
 
-	r.Stdout = stdout
-	r.Stderr = stderr
 	// Send stdin.
-	reqStdin := newStreamWriter(r.conn.netconn, fcgiStdin, r.id)
-	io.Copy(reqStdin, stdin)
-	reqStdin.Close()
+	reqStdin := newStreamWriter(r.conn, fcgiStdin, r.id)
+	_, err := io.Copy(reqStdin, ctxReader{ctx, stdin})
+	timedOut := errors.Is(err, os.ErrDeadlineExceeded)
+	timedOut = errors.Is(reqStdin.Close(), os.ErrDeadlineExceeded) || timedOut
 
-	// Wait for end request.
-	<-r.done
-	return nil
+	// Send data.
+	if role == fcgiFilter {
+		reqData := newStreamWriter(r.conn, fcgiData, r.id)
+		if data != nil {
+			_, err = io.Copy(reqData, ctxReader{ctx, data})
+			timedOut = errors.Is(err, os.ErrDeadlineExceeded) || timedOut
+		}
+		timedOut = errors.Is(reqData.Close(), os.ErrDeadlineExceeded) || timedOut
+	}
+	stopSend()
+	if deadline {
+		r.conn.netconn.SetWriteDeadline(time.Time{})
+	}
+	if timedOut {
+		// Part of a record may have been written, so the connection is no good.
+		cancel(&SendTimeoutError{Limit: s.Timeouts.Send})
+		s.reqLock.Lock()
+		s.dropConn(r.conn)
+		s.reqLock.Unlock()
+	}
+
+	// Wait for end request, and for the output to be passed on. A cancelled
+	// request's leftover output is thrown away.
+	s.awaitEnd(r, cancel)
+	cancelled := !stop()
+	r.out.close(cancelled)
+	if cancelled {
+		return context.Cause(ctx)
+	}
+	return r.err
+}
+
+// awaitEnd waits for a request to end, cancelling it if the application is too
+// slow to start or continue its output.
+func (s *FCGIRequester) awaitEnd(r *request, cancel context.CancelCauseFunc) {
+	var clock *time.Timer
+	var expired <-chan time.Time
+	var cause error
+	setClock := func(d time.Duration, err error) {
+		if clock != nil {
+			clock.Stop()
+		}
+		clock, expired, cause = nil, nil, err
+		if d > 0 {
+			clock = time.NewTimer(d)
+			expired = clock.C
+		}
+	}
+	defer setClock(0, nil)
+
+	setClock(s.Timeouts.FirstByte, &FirstByteTimeoutError{Limit: s.Timeouts.FirstByte})
+	started := false
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.progress:
+			if started = started || atomic.LoadInt32(&r.gotStdout) != 0; started {
+				setClock(s.Timeouts.Idle, &IdleTimeoutError{Limit: s.Timeouts.Idle})
+			}
+		case <-expired:
+			cancel(cause)
+			setClock(0, nil)
+		}
+	}
+}
+
+// abortRequest asks the application to abort a request, and closes the request's
+// connection if the application doesn't end it soon enough.
+func (s *FCGIRequester) abortRequest(r *request) {
+	timeout := s.AbortTimeout
+	if timeout == 0 {
+		timeout = DefaultAbortTimeout
+	}
+	time.AfterFunc(timeout, func() {
+		s.reqLock.Lock()
+		defer s.reqLock.Unlock()
+		if r.conn.findRequest(r.id) == r {
+			s.logger().Warn("Application did not answer abort; closing connection",
+				"backend", dialerName(s.dialer), "timeout", timeout)
+			s.dropConn(r.conn)
+		}
+	})
+	// Hold the write lock while checking, so that if the request has already
+	// ended its id can't have been handed to a new request on the wire.
+	r.conn.writeLock.Lock()
+	defer r.conn.writeLock.Unlock()
+	if r.conn.findRequest(r.id) == r {
+		writeRecord(r.conn.netconn, record{fcgiAbortRequest, r.id, nil})
+	}
 }
 
-// ServeHTTP serves an HTTP request.
+// ServeHTTP serves an HTTP request. The application's output is streamed to the
+// client according to Flush, and its error output goes to Logger according to Stderr.
 func (s *FCGIRequester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	env := HTTPEnv(nil, r)
-	buffer := bytes.NewBuffer(nil)
-	s.Request(env, r.Body, buffer, os.Stderr)
+	if s.Env != nil {
+		env = s.Env.Env(nil, r)
+	}
+	redirect := s.LocalRedirect
+	if redirect == nil {
+		redirect = s
+	}
+	opts := responseOptions{s.Flush, s.FlushSize, redirect, s.ErrorHandler, s.logger()}
+	env, body, cleanup, err := requestBody(env, r, s.Spool)
+	if err != nil {
+		serveError(w, r, opts, err)
+		return
+	}
+	defer cleanup()
+	stderr := newAppStderr(s.Stderr, s.logger(), r, dialerName(s.dialer), env)
+	serveResponse(w, r, opts, func(stdout, _ io.Writer) error {
+		return stderr.done(s.RequestContext(r.Context(), env, body, stdout, stderr))
+	})
+}
 
-	// Add any headers produced by the application, and skip to the response.
-	ProcessResponse(buffer, w, r)
+func (s *FCGIRequester) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
 }
 
+// numRequests counts the requests in progress, including those still dialing.
 // Should only be called if reqLock is held.
 func (s *FCGIRequester) numRequests() int {
-	var n = 0
+	var n = s.reserved
 	for _, c := range s.connections {
 		n += c.numRequests()
 	}
 	return n
 }
 
-func (s *FCGIRequester) newRequest() (*request, error) {
+// findConn returns an open kept connection that can take another request,
+// or nil if a new connection should be dialed.
+// Should only be called if reqLock is held.
+func (s *FCGIRequester) findConn() *conn {
+	now := time.Now()
+	var best *conn
+	bestN := 0
+	for _, c := range s.connections {
+		if !c.keepConn || !s.usable(c, now) {
+			continue
+		}
+		n := c.numRequests()
+		if n >= maxRequestId || (n > 0 && !s.CanMultiplex) {
+			continue
+		}
+		if best == nil || n < bestN {
+			best, bestN = c, n
+		}
+	}
+	// Prefer an idle connection, then a new one, then sharing a busy one.
+	if best != nil && bestN > 0 && (s.MaxConns <= 0 || len(s.connections)+len(s.dialing) < s.MaxConns) {
+		return nil
+	}
+	return best
+}
+
+// usable reports whether a kept connection may take new requests. Connections
+// the application has closed are dropped by their Run loop as soon as the
+// close is seen, so all that's left to check is our own limits.
+// Should only be called if reqLock is held.
+func (s *FCGIRequester) usable(c *conn, now time.Time) bool {
+	if c.closed {
+		return false
+	}
+	if s.MaxConnLifetime > 0 && now.Sub(c.created) >= s.MaxConnLifetime {
+		return false
+	}
+	if s.IdleTimeout > 0 && c.numRequests() == 0 && now.Sub(c.idleSince) >= s.IdleTimeout {
+		return false
+	}
+	return true
+}
+
+// idleConn puts a kept connection with no requests back in the pool, or
+// closes it if it is too old to be reused.
+// Should only be called if reqLock is held.
+func (s *FCGIRequester) idleConn(c *conn) {
+	now := time.Now()
+	c.idleSince = now
+	if !s.usable(c, now) {
+		s.dropConn(c)
+		return
+	}
+	if s.IdleTimeout > 0 {
+		time.AfterFunc(s.IdleTimeout, func() {
+			s.reqLock.Lock()
+			defer s.reqLock.Unlock()
+			if c.numRequests() == 0 && !s.usable(c, time.Now()) {
+				s.dropConn(c)
+			}
+		})
+	}
+}
+
+// newRequest allocates a request on some connection. cancel is how Close cancels it.
+// If fresh is set, a new connection is dialed even if a kept one is free.
+func (s *FCGIRequester) newRequest(ctx context.Context, cancel context.CancelCauseFunc, role uint16, fresh bool, stdout, stderr io.Writer) (*request, error) {
 	// We may have to wait for one to become available
 	s.reqLock.Lock()
 	defer s.reqLock.Unlock()
-	for s.numRequests() >= s.MaxRequests {
+	if err := s.waitForSlot(ctx); err != nil {
+		return nil, err
+	}
+	s.reserved++
+	defer func() { s.reserved-- }()
+	keep := s.CanMultiplex || s.KeepConns
+	stop := context.AfterFunc(ctx, func() {
+		s.reqLock.Lock()
+		s.reqCond.Broadcast()
+		s.reqLock.Unlock()
+	})
+	defer stop()
+	for {
+		// Shutdown may have started while we waited.
+		if s.closing {
+			s.reqCond.Broadcast()
+			return nil, ErrClosed
+		}
+		if err := ctx.Err(); err != nil {
+			s.reqCond.Broadcast()
+			return nil, err
+		}
+		if keep && !fresh {
+			if c := s.findConn(); c != nil {
+				r := c.newRequest(cancel, role, stdout, stderr)
+				r.reused = true
+				return r, nil
+			}
+		}
+		// If we can't have another connection, wait for the one being dialed.
+		if !keep || s.MaxConns <= 0 || len(s.dialing) == 0 || len(s.connections)+len(s.dialing) < s.MaxConns {
+			break
+		}
 		s.reqCond.Wait()
 	}
-	// We will always need to create a new connection, for now.
-	netconn, err := s.dialer.Dial()
+
+	// Dial without the lock, which would hold up every other connection, but keep
+	// the slot so that nobody else takes it meanwhile.
+	pd := &pendingDial{cancel: cancel}
+	if s.dialing == nil {
+		s.dialing = make(map[*pendingDial]bool)
+	}
+	s.dialing[pd] = true
+	s.reqLock.Unlock()
+	netconn, err := s.Timeouts.dial(ctx, s.dialer)
+	s.reqLock.Lock()
+	delete(s.dialing, pd)
+	// Anyone waiting for this connection can look again.
+	s.reqCond.Broadcast()
+	if err == nil && s.closing {
+		netconn.Close()
+		err = ErrClosed
+	}
 	if err != nil {
 		return nil, err
 	}
 	conn := newConn(s, netconn)
+	// A multiplexed connection has to outlive any one request on it.
+	conn.keepConn = s.CanMultiplex || s.KeepConns
+	s.connections = append(s.connections, conn)
 	go conn.Run()
-	return conn.newRequest(), nil
+	return conn.newRequest(cancel, role, stdout, stderr), nil
 }
 
 func (s *FCGIRequester) releaseRequest(r *request) {
 	s.reqLock.Lock()
 	defer s.reqLock.Unlock()
-	r.conn.removeRequest(r)
-	// For now, we're telling apps to close connections, so we're done with it.
-	// But we're not trusting apps to do it, because not all of them do, the bastards.
-	r.conn.netconn.Close()
-	for i, c := range s.connections {
-		if c == r.conn {
+	if !r.conn.removeRequest(r) {
+		// Already released.
+		return
+	}
+	if _, ok := r.err.(*CantMultiplexError); ok {
+		// Don't try that again.
+		s.CanMultiplex = false
+	}
+	// Without FCGI_KEEP_CONN the app should close the connection, but we're not
+	// trusting apps to do it, because not all of them do, the bastards.
+	if !r.conn.keepConn {
+		s.dropConn(r.conn)
+	} else if r.conn.numRequests() == 0 {
+		s.idleConn(r.conn)
+	}
+	close(r.done)
+	s.reqCond.Broadcast()
+}
+
+// dropConn closes a connection and forgets about it.
+// Should only be called if reqLock is held.
+func (s *FCGIRequester) dropConn(c *conn) {
+	c.closed = true
+	c.netconn.Close()
+	for i, sc := range s.connections {
+		if sc == c {
 			s.connections = append(s.connections[:i], s.connections[i+1:]...)
 			break
 		}
 	}
-	if r.done != nil {
-		close(r.done)
-	}
-	s.reqCond.Signal()
+}
+
+// pendingDial is a request dialing a new connection.
+type pendingDial struct {
+	cancel context.CancelCauseFunc
 }
 
 // Conn wraps a net.Conn. It may multiplex many requests.
 type conn struct {
-	server   *FCGIRequester
-	netconn  net.Conn
-	requests []*request
-	numReq   int
-	reqLock  sync.RWMutex
+	server    *FCGIRequester
+	netconn   net.Conn
+	keepConn  bool
+	closed    bool // set when dropped; guarded by the server's reqLock
+	created   time.Time
+	idleSince time.Time
+	requests  []*request
+	numReq    int
+	reqLock   sync.RWMutex
+	writeLock sync.Mutex
 }
 
 func newConn(s *FCGIRequester, netconn net.Conn) *conn {
-	return &conn{server: s, netconn: netconn}
+	return &conn{server: s, netconn: netconn, created: time.Now()}
+}
+
+// Write writes to the underlying connection. Records are written with a single
+// Write, so requests sharing the connection will not interleave them.
+func (c *conn) Write(data []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.netconn.Write(data)
 }
 
-func (c *conn) newRequest() *request {
-	// For now, there shouldn't be anything there.
-	// But pretend.
+// newRequest allocates the lowest free request id on the connection.
+func (c *conn) newRequest(cancel context.CancelCauseFunc, role uint16, stdout, stderr io.Writer) *request {
 	c.reqLock.Lock()
 	defer c.reqLock.Unlock()
-	r := &request{conn: c}
+	r := &request{conn: c, role: role, cancel: cancel, Stdout: stdout, Stderr: stderr}
 	r.done = make(chan bool)
+	r.progress = make(chan struct{}, 1)
+	r.alone = !c.server.CanMultiplex
+	// Only a connection of its own can be held up for the request's client.
+	r.out = newOutputQueue(r.alone, func() {
+		cancel(&SlowClientError{Limit: maxQueuedOutput})
+	})
 	c.numReq++
-	for i, r := range c.requests {
-		if r == nil {
+	for i, old := range c.requests {
+		if old == nil {
 			r.id = requestId(i + 1)
 			c.requests[i] = r
 			return r
@@ -242,60 +661,68 @@ func (c *conn) newRequest() *request {
 	return r
 }
 
-func (c *conn) removeRequest(r *request) {
+// removeRequest frees the request's id. It returns false if the request was
+// not active on the connection.
+func (c *conn) removeRequest(r *request) bool {
 	c.reqLock.Lock()
 	defer c.reqLock.Unlock()
 	idx := int(r.id) - 1
-	if c.requests[idx] == r {
+	if idx < len(c.requests) && c.requests[idx] == r {
 		c.requests[idx] = nil
 		c.numReq--
+		return true
 	}
+	return false
 }
 
-func (c *conn) releaseAllRequests() {
+// releaseAllRequests ends every request on the connection with err.
+func (c *conn) releaseAllRequests(err error) {
 	c.reqLock.Lock()
 	var reqs []*request
 	reqs = append(reqs, c.requests...)
 	c.reqLock.Unlock()
 	for _, r := range reqs {
 		if r != nil {
+			r.err = &ConnectionDroppedError{Err: err}
 			c.server.releaseRequest(r)
 		}
 	}
+	// The connection is no good any more, even if nothing was using it.
+	c.server.reqLock.Lock()
+	c.server.dropConn(c)
+	c.server.reqLock.Unlock()
 }
 
 func (c *conn) numRequests() int {
-	c.reqLock.Lock()
-	defer c.reqLock.Unlock()
+	c.reqLock.RLock()
+	defer c.reqLock.RUnlock()
 	return c.numReq
 }
 
 func (c *conn) findRequest(id requestId) *request {
-	c.reqLock.Lock()
-	defer c.reqLock.Unlock()
+	c.reqLock.RLock()
+	defer c.reqLock.RUnlock()
 	idx := int(id) - 1
-	if int(idx) >= len(c.requests) {
+	if idx < 0 || idx >= len(c.requests) {
 		return nil
 	}
 	return c.requests[idx]
 }
 
+// Run reads records from the application and dispatches them to the requests
+// they belong to, until the connection is closed.
 func (c *conn) Run() error {
 	// Sit in a loop reading records.
 	for {
 		rec, err := readRecord(c.netconn)
 		if err != nil {
 			// We're done?
-			c.releaseAllRequests()
+			c.releaseAllRequests(err)
 			return err
 		}
-		// If it's a management record
-		if rec.Id == 0 {
-			switch rec.Type {
-			case fcgiGetValuesResult:
-				c.server.processGetValuesResult(rec)
-			}
-		} else {
+		// Management records are ignored; we don't send any on request
+		// connections. See Probe.
+		if rec.Id != 0 {
 			// Get the request.
 			req := c.findRequest(rec.Id)
 			// If there isn't one, ignore it.
@@ -305,30 +732,205 @@ func (c *conn) Run() error {
 			switch rec.Type {
 			case fcgiEndRequest:
 				// We're done!
+				appStatus, protocolStatus, err := readEndRequest(rec.Content)
+				if err != nil {
+					req.err = err
+				} else {
+					req.err = endRequestError(req.role, appStatus, protocolStatus)
+				}
 				c.server.releaseRequest(req)
 			case fcgiStdout:
-				// Write the data to the stdout stream
+				// Queue the data for the stdout stream. Writing it here would
+				// hold up every other request on the connection, if there are any.
+				req.noteOutput(len(rec.Content) > 0)
 				if len(rec.Content) > 0 {
-					if _, err := req.Stdout.Write(rec.Content); err != nil {
-					}
+					req.out.write(req.Stdout, rec.Content)
 				}
 			case fcgiStderr:
-				// Write the data to the stderr stream
+				// Likewise for stderr.
+				req.noteOutput(false)
 				if len(rec.Content) > 0 {
-					if _, err := req.Stderr.Write(rec.Content); err != nil {
-					}
+					req.out.write(req.Stderr, rec.Content)
 				}
 			}
 		}
 	}
-	return nil
 }
 
 // Request is a single request.
 type request struct {
 	id     requestId
+	role   uint16
 	conn   *conn
+	cancel context.CancelCauseFunc
 	done   chan bool
+	err    error // how the request ended; set before done is closed
 	Stdout io.Writer
 	Stderr io.Writer
+	out    *outputQueue // passes output on to Stdout and Stderr
+
+	// reused is set if the request was put on a kept connection, and unsent if
+	// the application can't have had all of it. alone is set if no other request
+	// can share the connection.
+	reused bool
+	unsent bool
+	alone  bool
+
+	// For timeouts: progress is signalled whenever output arrives.
+	progress  chan struct{}
+	gotStdout int32
+	gotOutput int32
+}
+
+// maxQueuedOutput is the most output held for a request whose client is slower
+// than the application.
+const maxQueuedOutput = 4 * maxRecordContent
+
+// outputQueue passes a request's output on from a goroutine of its own, so that
+// the connection's read loop needn't wait on a slow client. Up to maxQueuedOutput
+// is held in memory meanwhile. Once that is reached, write waits for room if block
+// is set, and otherwise gives up on the request, calling overflow.
+type outputQueue struct {
+	lock     sync.Mutex
+	cond     sync.Cond
+	pending  []queuedOutput
+	size     int // bytes pending or being written
+	block    bool
+	overflow func()
+	closed   bool
+	done     chan struct{}
+}
+
+type queuedOutput struct {
+	w    io.Writer
+	data []byte
+}
+
+func newOutputQueue(block bool, overflow func()) *outputQueue {
+	q := &outputQueue{block: block, overflow: overflow, done: make(chan struct{})}
+	q.cond.L = &q.lock
+	go q.run()
+	return q
+}
+
+// write queues data for w. Once the queue is closed, data is thrown away.
+func (q *outputQueue) write(w io.Writer, data []byte) {
+	q.lock.Lock()
+	for q.block && !q.closed && q.size+len(data) > maxQueuedOutput {
+		q.cond.Wait()
+	}
+	if q.closed {
+		q.lock.Unlock()
+		return
+	}
+	if q.size+len(data) > maxQueuedOutput {
+		q.closed, q.pending = true, nil
+		q.cond.Broadcast()
+		q.lock.Unlock()
+		q.overflow()
+		return
+	}
+	q.pending = append(q.pending, queuedOutput{w, data})
+	q.size += len(data)
+	q.cond.Broadcast()
+	q.lock.Unlock()
+}
+
+// discard throws away anything queued, and any more output.
+func (q *outputQueue) discard() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed, q.pending = true, nil
+	q.cond.Broadcast()
+}
+
+// close waits for everything queued to be written, or if discard is set, only
+// for what is being written now.
+func (q *outputQueue) close(discard bool) {
+	q.lock.Lock()
+	q.closed = true
+	if discard {
+		q.pending = nil
+	}
+	q.cond.Broadcast()
+	q.lock.Unlock()
+	<-q.done
+}
+
+func (q *outputQueue) run() {
+	defer close(q.done)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.pending) == 0 {
+			return
+		}
+		out := q.pending[0]
+		q.pending[0] = queuedOutput{}
+		q.pending = q.pending[1:]
+		q.lock.Unlock()
+		// There's nobody to tell if this fails.
+		out.w.Write(out.data)
+		q.lock.Lock()
+		q.size -= len(out.data)
+		q.cond.Broadcast()
+	}
+}
+
+// noteOutput records that output has arrived.
+func (r *request) noteOutput(stdout bool) {
+	if stdout {
+		atomic.StoreInt32(&r.gotStdout, 1)
+	}
+	atomic.StoreInt32(&r.gotOutput, 1)
+	select {
+	case r.progress <- struct{}{}:
+	default:
+	}
+}
+
+// idempotentMethods are the request methods that can safely be run twice.
+var idempotentMethods = map[string]bool{
+	"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true, "PUT": true, "DELETE": true,
+}
+
+// idempotent reports whether the request env describes can safely be run twice.
+func idempotent(env []string) bool {
+	return idempotentMethods[envValue(env, "REQUEST_METHOD")]
+}
+
+// maxReplay is the most input kept so that a request can be sent again.
+const maxReplay = 64 << 10
+
+// replayReader remembers what is read through it, up to maxReplay bytes, so that
+// it can be read again.
+type replayReader struct {
+	r     io.Reader
+	saved []byte
+	over  bool
+}
+
+func (rr *replayReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if !rr.over {
+		if len(rr.saved)+n > maxReplay {
+			rr.over, rr.saved = true, nil
+		} else {
+			rr.saved = append(rr.saved, p[:n]...)
+		}
+	}
+	return n, err
+}
+
+// rewind goes back to the beginning. It returns false if too much was read to do so.
+func (rr *replayReader) rewind() bool {
+	if rr.over {
+		return false
+	}
+	rr.r = io.MultiReader(bytes.NewReader(rr.saved), rr.r)
+	rr.saved = nil
+	return true
 }
@@ -0,0 +1,264 @@
+package gofcgisrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoBackends is returned by a Group with no healthy members to send a request to.
+var ErrNoBackends = errors.New("No backends available")
+
+// Balance says how a Group chooses a member for each request.
+type Balance int
+
+const (
+	// BalanceRoundRobin takes members in turn.
+	BalanceRoundRobin Balance = iota
+	// BalanceWeighted takes members in turn, in proportion to their weights.
+	BalanceWeighted
+	// BalanceLeastOutstanding takes the member with the fewest requests in flight.
+	BalanceLeastOutstanding
+	// BalanceHash sends requests with the same key to the same member, moving as few
+	// keys as possible when members come and go.
+	BalanceHash
+)
+
+// hashPointsPerWeight is how many points each unit of weight gets on the hash ring.
+const hashPointsPerWeight = 100
+
+// A Member is one backend in a Group.
+type Member struct {
+	// Name identifies the member in its group, and places it on the hash ring.
+	Name      string
+	Requester Requester
+	// Weight is the member's share of requests for BalanceWeighted and BalanceHash.
+	// Zero means 1.
+	Weight int
+
+	inFlight atomic.Int64
+	current  int // for smooth weighted round robin
+	health   memberHealth
+}
+
+// InFlight returns how many requests the member is working on.
+func (m *Member) InFlight() int {
+	return int(m.inFlight.Load())
+}
+
+func (m *Member) weight() int {
+	if m.Weight <= 0 {
+		return 1
+	}
+	return m.Weight
+}
+
+// A ringPoint is one of a member's points on the hash ring.
+type ringPoint struct {
+	hash   uint32
+	member *Member
+}
+
+// Group is a Requester that spreads requests over several backends.
+// Members may join and leave while requests are running.
+type Group struct {
+	Balance Balance
+
+	// HashKey returns the key to hash for BalanceHash, if the request's context has
+	// none (see WithHashKey). If nil, REMOTE_ADDR is used.
+	HashKey func(env []string) string
+
+	// Health, if set, takes failing members out of rotation for a while.
+	Health *HealthCheck
+
+	lock       sync.Mutex
+	members    []*Member
+	next       int
+	ring       []ringPoint
+	stopChecks chan struct{}
+}
+
+// NewGroup returns an empty group.
+func NewGroup(balance Balance) *Group {
+	return &Group{Balance: balance}
+}
+
+// Join adds a member to the group. Names must be unique.
+func (g *Group) Join(m *Member) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, other := range g.members {
+		if other.Name == m.Name {
+			return fmt.Errorf("Backend %q is already in the group", m.Name)
+		}
+	}
+	g.members = append(g.members, m)
+	g.buildRing()
+	return nil
+}
+
+// JoinDialer adds a FastCGI backend reached with d.
+func (g *Group) JoinDialer(name string, d Dialer, weight int) (*Member, error) {
+	m := &Member{Name: name, Requester: NewFCGIDialer(d), Weight: weight}
+	return m, g.Join(m)
+}
+
+// Leave removes the named member, reporting whether it was there. Its requests in
+// flight carry on.
+func (g *Group) Leave(name string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for i, m := range g.members {
+		if m.Name == name {
+			g.members = append(g.members[:i:i], g.members[i+1:]...)
+			g.buildRing()
+			return true
+		}
+	}
+	return false
+}
+
+// Members returns the group's current members.
+func (g *Group) Members() []*Member {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return append([]*Member(nil), g.members...)
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	io.WriteString(h, s)
+	return h.Sum32()
+}
+
+// buildRing rebuilds the hash ring.
+// Should only be called if lock is held.
+func (g *Group) buildRing() {
+	g.ring = g.ring[:0]
+	for _, m := range g.members {
+		for i := 0; i < m.weight()*hashPointsPerWeight; i++ {
+			g.ring = append(g.ring, ringPoint{hashString(m.Name + "#" + strconv.Itoa(i)), m})
+		}
+	}
+	sort.Slice(g.ring, func(i, j int) bool { return g.ring[i].hash < g.ring[j].hash })
+}
+
+type hashKeyKey struct{}
+
+// WithHashKey returns a context whose requests to a BalanceHash group are placed by key.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyKey{}, key)
+}
+
+// hashKey returns the key to place a request by.
+func (g *Group) hashKey(ctx context.Context, env []string) string {
+	if key, ok := ctx.Value(hashKeyKey{}).(string); ok {
+		return key
+	}
+	if g.HashKey != nil {
+		return g.HashKey(env)
+	}
+	for _, e := range env {
+		if k, v, err := parseEnv(e); err == nil && k == "REMOTE_ADDR" {
+			return v
+		}
+	}
+	return ""
+}
+
+// choose picks the member for a request and counts it as in flight. trial is whether
+// the request is a half-open member's trial.
+func (g *Group) choose(ctx context.Context, env []string) (m *Member, trial bool, err error) {
+	var changes []stateChange
+	defer func() { g.Health.notify(changes) }()
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := time.Now()
+	ok := func(c *Member) bool {
+		return c.available(g.Health, now, &changes)
+	}
+	n := len(g.members)
+	switch g.Balance {
+	case BalanceWeighted:
+		// Smooth weighted round robin, as nginx does it.
+		total := 0
+		for _, c := range g.members {
+			if !ok(c) {
+				continue
+			}
+			c.current += c.weight()
+			total += c.weight()
+			if m == nil || c.current > m.current {
+				m = c
+			}
+		}
+		if m != nil {
+			m.current -= total
+		}
+	case BalanceLeastOutstanding:
+		// Start after the last choice, so ties go round robin.
+		for i := 0; i < n; i++ {
+			c := g.members[(g.next+i)%n]
+			if ok(c) && (m == nil || c.InFlight() < m.InFlight()) {
+				m = c
+			}
+		}
+		g.next++
+	case BalanceHash:
+		// Take the first usable member at or after the key's place on the ring.
+		h := hashString(g.hashKey(ctx, env))
+		start := sort.Search(len(g.ring), func(i int) bool { return g.ring[i].hash >= h })
+		for i := 0; i < len(g.ring); i++ {
+			if c := g.ring[(start+i)%len(g.ring)].member; ok(c) {
+				m = c
+				break
+			}
+		}
+	default:
+		for i := 0; i < n; i++ {
+			if c := g.members[(g.next+i)%n]; ok(c) {
+				m = c
+				g.next += i + 1
+				break
+			}
+		}
+	}
+	if m == nil {
+		return nil, false, ErrNoBackends
+	}
+	m.inFlight.Add(1)
+	return m, m.take(g.Health), nil
+}
+
+func (g *Group) Request(env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	return g.RequestContext(context.Background(), env, stdin, stdout, stderr)
+}
+
+// RequestContext sends the request to one of the group's members.
+func (g *Group) RequestContext(ctx context.Context, env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	m, trial, err := g.choose(ctx, env)
+	if err != nil {
+		return err
+	}
+	err = RequestContext(ctx, m.Requester, env, stdin, stdout, stderr)
+	m.inFlight.Add(-1)
+	var changes []stateChange
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// A cancelled request says nothing either way.
+		m.endTrial(trial)
+	case isBackendFailure(err):
+		m.record(g.Health, true, trial, time.Now(), &changes)
+	default:
+		m.record(g.Health, false, trial, time.Now(), &changes)
+	}
+	g.Health.notify(changes)
+	return err
+}
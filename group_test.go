@@ -0,0 +1,114 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// namedBackend answers every request with its name.
+func namedBackend(name string) *Member {
+	return &Member{Name: name, Requester: RequesterFunc(func(env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+		_, err := io.WriteString(stdout, name)
+		return err
+	})}
+}
+
+func groupRequest(t *testing.T, g *Group, ctx context.Context) string {
+	var stdout bytes.Buffer
+	if err := g.RequestContext(ctx, []string{"REMOTE_ADDR=10.0.0.1"}, strings.NewReader(""), &stdout, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String()
+}
+
+func TestGroupBalance(t *testing.T) {
+	g := NewGroup(BalanceRoundRobin)
+	if err := g.Request(nil, strings.NewReader(""), io.Discard, io.Discard); err != ErrNoBackends || ErrorStatus(err) != 502 {
+		t.Errorf("Empty group returned %v", err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		g.Join(namedBackend(name))
+	}
+	if err := g.Join(namedBackend("a")); err == nil {
+		t.Errorf("Duplicate name was accepted")
+	}
+	var order []string
+	for i := 0; i < 6; i++ {
+		order = append(order, groupRequest(t, g, context.Background()))
+	}
+	if strings.Join(order, "") != "abcabc" {
+		t.Errorf("Round robin order was %v", order)
+	}
+
+	g = NewGroup(BalanceWeighted)
+	heavy := namedBackend("heavy")
+	heavy.Weight = 3
+	g.Join(heavy)
+	g.Join(namedBackend("light"))
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[groupRequest(t, g, context.Background())]++
+	}
+	if counts["heavy"] != 6 || counts["light"] != 2 {
+		t.Errorf("Weighted counts were %v", counts)
+	}
+}
+
+func TestGroupLeastOutstanding(t *testing.T) {
+	release := make(chan struct{})
+	slow := &Member{Name: "slow", Requester: RequesterFunc(func(env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+		<-release
+		return nil
+	})}
+	g := NewGroup(BalanceLeastOutstanding)
+	g.Join(slow)
+	g.Join(namedBackend("fast"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.Request(nil, strings.NewReader(""), io.Discard, io.Discard)
+	}()
+	for slow.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if name := groupRequest(t, g, context.Background()); name != "fast" {
+			t.Errorf("Request went to %s", name)
+		}
+	}
+	close(release)
+	<-done
+	if slow.InFlight() != 0 {
+		t.Errorf("%d requests still in flight", slow.InFlight())
+	}
+}
+
+func TestGroupHash(t *testing.T) {
+	g := NewGroup(BalanceHash)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		g.Join(namedBackend(name))
+	}
+	placed := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key := "user" + strconv.Itoa(i)
+		placed[key] = groupRequest(t, g, WithHashKey(context.Background(), key))
+		if again := groupRequest(t, g, WithHashKey(context.Background(), key)); again != placed[key] {
+			t.Errorf("%s went to %s, then %s", key, placed[key], again)
+		}
+	}
+
+	// Only keys on the departed member move.
+	g.Leave("b")
+	for key, name := range placed {
+		now := groupRequest(t, g, WithHashKey(context.Background(), key))
+		if now == "b" || (name != "b" && now != name) {
+			t.Errorf("%s moved from %s to %s", key, name, now)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthState is where a Group member's circuit breaker stands.
+type HealthState int
+
+const (
+	// Healthy members take requests.
+	Healthy HealthState = iota
+	// Unhealthy members take no requests until their cooldown is over.
+	Unhealthy
+	// HalfOpen members take one trial request. If it works they are Healthy again.
+	HalfOpen
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case Healthy:
+		return "healthy"
+	case Unhealthy:
+		return "unhealthy"
+	case HalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("HealthState(%d)", int(s))
+}
+
+// Defaults for HealthCheck.
+const (
+	DefaultFailureThreshold = 5
+	DefaultCooldown         = 10 * time.Second
+)
+
+// A ProbeFunc checks whether a member is working.
+type ProbeFunc func(ctx context.Context, m *Member) error
+
+// HealthCheck configures the health checking of a Group's members. Failures of real
+// requests (dial errors, overloads, dropped connections and timeouts) count, as do
+// failed probes if Interval is set. A successful probe makes a member healthy at once.
+type HealthCheck struct {
+	// FailureThreshold is how many failures in a row make a member unhealthy.
+	// Zero means DefaultFailureThreshold.
+	FailureThreshold int
+	// Cooldown is how long an unhealthy member is left alone before a trial request.
+	// Zero means DefaultCooldown.
+	Cooldown time.Duration
+
+	// Interval is how often members are probed. Zero means they aren't.
+	Interval time.Duration
+	// Timeout limits each probe. Zero means DefaultProbeTimeout.
+	Timeout time.Duration
+	// Probe checks a member. If nil, ConnectProbe is used.
+	Probe ProbeFunc
+
+	// OnStateChange, if set, is called whenever a member changes state.
+	OnStateChange func(m *Member, from, to HealthState)
+}
+
+func (h *HealthCheck) threshold() int {
+	if h.FailureThreshold <= 0 {
+		return DefaultFailureThreshold
+	}
+	return h.FailureThreshold
+}
+
+func (h *HealthCheck) cooldown() time.Duration {
+	if h.Cooldown <= 0 {
+		return DefaultCooldown
+	}
+	return h.Cooldown
+}
+
+// memberHealth is a member's circuit breaker.
+type memberHealth struct {
+	lock     sync.Mutex
+	state    HealthState
+	failures int
+	openedAt time.Time
+	trial    bool // a half-open trial request is in flight
+}
+
+// A stateChange is a transition to report to OnStateChange.
+type stateChange struct {
+	member   *Member
+	from, to HealthState
+}
+
+// notify reports state changes. It should be called without any locks held.
+func (h *HealthCheck) notify(changes []stateChange) {
+	if h == nil || h.OnStateChange == nil {
+		return
+	}
+	for _, c := range changes {
+		h.OnStateChange(c.member, c.from, c.to)
+	}
+}
+
+// State returns the member's health.
+func (m *Member) State() HealthState {
+	m.health.lock.Lock()
+	defer m.health.lock.Unlock()
+	return m.health.state
+}
+
+// setState changes state, noting the change.
+// Should only be called if m.health.lock is held.
+func (m *Member) setState(to HealthState, changes *[]stateChange) {
+	if m.health.state != to {
+		*changes = append(*changes, stateChange{m, m.health.state, to})
+		m.health.state = to
+	}
+}
+
+// available reports whether m can take a request, moving it to half-open if its
+// cooldown is over.
+func (m *Member) available(h *HealthCheck, now time.Time, changes *[]stateChange) bool {
+	if h == nil {
+		return true
+	}
+	m.health.lock.Lock()
+	defer m.health.lock.Unlock()
+	if m.health.state == Unhealthy && now.Sub(m.health.openedAt) >= h.cooldown() {
+		m.setState(HalfOpen, changes)
+	}
+	switch m.health.state {
+	case Unhealthy:
+		return false
+	case HalfOpen:
+		return !m.health.trial
+	}
+	return true
+}
+
+// take notes that m was chosen, returning whether the request is its half-open trial.
+func (m *Member) take(h *HealthCheck) bool {
+	if h == nil {
+		return false
+	}
+	m.health.lock.Lock()
+	defer m.health.lock.Unlock()
+	if m.health.state == HalfOpen {
+		m.health.trial = true
+		return true
+	}
+	return false
+}
+
+// endTrial lets another trial request go to a half-open member.
+func (m *Member) endTrial(trial bool) {
+	if trial {
+		m.health.lock.Lock()
+		m.health.trial = false
+		m.health.lock.Unlock()
+	}
+}
+
+// record counts the outcome of a request or probe.
+func (m *Member) record(h *HealthCheck, failed, trial bool, now time.Time, changes *[]stateChange) {
+	if h == nil {
+		return
+	}
+	m.health.lock.Lock()
+	defer m.health.lock.Unlock()
+	if trial {
+		m.health.trial = false
+	}
+	if !failed {
+		m.health.failures = 0
+		m.setState(Healthy, changes)
+		return
+	}
+	m.health.failures++
+	if m.health.state == HalfOpen || m.health.failures >= h.threshold() {
+		m.health.openedAt = now
+		m.setState(Unhealthy, changes)
+	}
+}
+
+// isBackendFailure reports whether err means the backend, rather than the request,
+// is in trouble.
+func isBackendFailure(err error) bool {
+	var netErr net.Error
+	var dial *DialError
+	var overloaded *OverloadedError
+	var dropped *ConnectionDroppedError
+	return errors.As(err, &dial) || errors.As(err, &overloaded) || errors.As(err, &dropped) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// memberDialer returns the Dialer behind a member, if it has one.
+func memberDialer(m *Member) (Dialer, bool) {
+	switch r := m.Requester.(type) {
+	case *FCGIRequester:
+		return r.dialer, true
+	case *SCGIRequester:
+		return r.dialer, true
+	}
+	return nil, false
+}
+
+// ConnectProbe checks that a connection can be made to a FastCGI or SCGI member.
+func ConnectProbe(ctx context.Context, m *Member) error {
+	d, ok := memberDialer(m)
+	if !ok {
+		return fmt.Errorf("Can't connect to backend %q", m.Name)
+	}
+	conn, err := dialContext(ctx, d)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// GetValuesProbe checks a FastCGI member by asking for its capabilities with FCGI_GET_VALUES.
+func GetValuesProbe(ctx context.Context, m *Member) error {
+	s, ok := m.Requester.(*FCGIRequester)
+	if !ok {
+		return fmt.Errorf("Backend %q is not FastCGI", m.Name)
+	}
+	_, err := s.Probe(ctx)
+	return err
+}
+
+// PingProbe returns a probe that sends a request with env to a member, which must answer
+// with a 200, like php-fpm's ping.path. A GET with no body is assumed unless env says otherwise.
+func PingProbe(env ...string) ProbeFunc {
+	seen := make(map[string]bool)
+	for _, e := range env {
+		if k, _, err := parseEnv(e); err == nil {
+			seen[k] = true
+		}
+	}
+	env = append([]string(nil), env...)
+	for _, e := range []string{"REQUEST_METHOD=GET", "SERVER_PROTOCOL=HTTP/1.1", "CONTENT_LENGTH=0", "GATEWAY_INTERFACE=CGI/1.1"} {
+		if k, _, _ := parseEnv(e); !seen[k] {
+			env = append(env, e)
+		}
+	}
+	return func(ctx context.Context, m *Member) error {
+		var stdout bytes.Buffer
+		if err := RequestContext(ctx, m.Requester, env, strings.NewReader(""), &stdout, io.Discard); err != nil {
+			return err
+		}
+		resp, err := ReadResponse(&stdout)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("Ping of backend %q returned %s", m.Name, resp.Status)
+		}
+		return nil
+	}
+}
+
+// StartHealthChecks starts probing the group's members every Health.Interval.
+// It does nothing if they are already being probed, or there is no interval.
+func (g *Group) StartHealthChecks() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.stopChecks != nil || g.Health == nil || g.Health.Interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	g.stopChecks = stop
+	go func() {
+		ticker := time.NewTicker(g.Health.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				g.CheckHealth(context.Background())
+			}
+		}
+	}()
+}
+
+// StopHealthChecks stops probing.
+func (g *Group) StopHealthChecks() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.stopChecks != nil {
+		close(g.stopChecks)
+		g.stopChecks = nil
+	}
+}
+
+// CheckHealth probes every member once, in parallel, and waits for the results.
+func (g *Group) CheckHealth(ctx context.Context) {
+	h := g.Health
+	if h == nil {
+		return
+	}
+	probe := h.Probe
+	if probe == nil {
+		probe = ConnectProbe
+	}
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	var wg sync.WaitGroup
+	for _, m := range g.Members() {
+		wg.Add(1)
+		go func(m *Member) {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, timeout)
+			err := probe(pctx, m)
+			cancel()
+			var changes []stateChange
+			m.record(h, err != nil, false, time.Now(), &changes)
+			h.notify(changes)
+		}(m)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,124 @@
+package gofcgisrv
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var broken int32 = 1
+	flaky := &Member{Name: "flaky", Requester: RequesterFunc(func(env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+		if atomic.LoadInt32(&broken) != 0 {
+			return &DialError{Err: io.ErrUnexpectedEOF}
+		}
+		_, err := io.WriteString(stdout, "flaky")
+		return err
+	})}
+
+	var lock sync.Mutex
+	var changes []string
+	g := NewGroup(BalanceRoundRobin)
+	g.Health = &HealthCheck{
+		FailureThreshold: 2,
+		Cooldown:         50 * time.Millisecond,
+		OnStateChange: func(m *Member, from, to HealthState) {
+			lock.Lock()
+			changes = append(changes, m.Name+":"+to.String())
+			lock.Unlock()
+		},
+	}
+	g.Join(flaky)
+	g.Join(namedBackend("steady"))
+
+	request := func() string {
+		var stdout strings.Builder
+		g.Request(nil, strings.NewReader(""), &stdout, io.Discard)
+		return stdout.String()
+	}
+	// Two failures open the circuit, and then flaky gets nothing.
+	for i := 0; i < 4; i++ {
+		request()
+	}
+	if flaky.State() != Unhealthy {
+		t.Fatalf("flaky is %v", flaky.State())
+	}
+	for i := 0; i < 4; i++ {
+		if got := request(); got != "steady" {
+			t.Errorf("Request went to %q", got)
+		}
+	}
+
+	// After the cooldown it gets a trial, which fails.
+	time.Sleep(60 * time.Millisecond)
+	request()
+	request()
+	if flaky.State() != Unhealthy {
+		t.Errorf("Failed trial left flaky %v", flaky.State())
+	}
+
+	// Next time it works.
+	atomic.StoreInt32(&broken, 0)
+	time.Sleep(60 * time.Millisecond)
+	seen := ""
+	for i := 0; i < 2; i++ {
+		seen += request()
+	}
+	if flaky.State() != Healthy || !strings.Contains(seen, "flaky") {
+		t.Errorf("flaky is %v after %q", flaky.State(), seen)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	want := "flaky:unhealthy flaky:half-open flaky:unhealthy flaky:half-open flaky:healthy"
+	if strings.Join(changes, " ") != want {
+		t.Errorf("State changes were %v", changes)
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	l, err := startFCGIApp(t, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	ctx := context.Background()
+	alive := &Member{Name: "alive", Requester: NewFCGI(l.Addr().String())}
+	gone := &Member{Name: "gone", Requester: NewFCGI(dead.Addr().String())}
+	ping := PingProbe("REQUEST_URI=/ping", "SERVER_NAME=localhost", "SERVER_PORT=80")
+	for _, probe := range []ProbeFunc{ConnectProbe, GetValuesProbe, ping} {
+		if err := probe(ctx, alive); err != nil {
+			t.Errorf("Probe of a live backend failed: %v", err)
+		}
+		if err := probe(ctx, gone); err == nil {
+			t.Errorf("Probe of a dead backend worked")
+		}
+	}
+	if err := ConnectProbe(ctx, namedBackend("func")); err == nil {
+		t.Errorf("Connect probe of a RequesterFunc worked")
+	}
+
+	g := NewGroup(BalanceRoundRobin)
+	g.Health = &HealthCheck{FailureThreshold: 1, Interval: 10 * time.Millisecond}
+	g.Join(alive)
+	g.Join(gone)
+	g.StartHealthChecks()
+	defer g.StopHealthChecks()
+	for i := 0; i < 100 && gone.State() == Healthy; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if gone.State() != Unhealthy || alive.State() != Healthy {
+		t.Errorf("States were %v and %v", alive.State(), gone.State())
+	}
+}
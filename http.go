@@ -3,12 +3,16 @@ package gofcgisrv
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"net"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/textproto"
+	"os/exec"
+	"strconv"
 	"strings"
 )
 
@@ -20,116 +24,256 @@ func parseEnv(envStr string) (key, value string, err error) {
 }
 
 // HTTPEnv sets up an environment with standard HTTP/CGI variables.
+// It uses a zero EnvBuilder; use one directly for scripts and document roots.
 func HTTPEnv(start []string, r *http.Request) []string {
-	envMap := make(map[string]string)
-	env := make([]string, 0, 10)
-	for _, e := range start {
-		if k, v, err := parseEnv(e); err == nil {
-			envMap[k] = v
-			env = append(env, e)
-		}
-	}
-
-	appendEnv := func(key, value string) {
-		if _, ok := envMap[key]; !ok {
-			env = append(env, key+"="+value)
-		}
-	}
-
-	appendEnv("SCRIPT_NAME", "")
-	appendEnv("REQUEST_METHOD", r.Method)
-	appendEnv("SERVER_PROTOCOL", "HTTP/1.1")
-	appendEnv("GATEWAY_INTERFACE", "CGI/1.1")
-	appendEnv("REQUEST_URI", r.URL.String())
-
-	host, port, err := net.SplitHostPort(r.Host)
-	if err != nil {
-		host, port = r.Host, "80"
-	}
-	appendEnv("REMOTE_ADDR", r.RemoteAddr)
-	appendEnv("SERVER_NAME", host)
-	appendEnv("SERVER_PORT", port)
-
-	appendEnv("QUERY_STRING", r.URL.RawQuery)
-	if t := r.Header.Get("Content-type"); t != "" {
-		appendEnv("CONTENT_TYPE", t)
-	}
-
-	for key := range r.Header {
-		upper := strings.ToUpper(key)
-		cgikey := "HTTP_" + strings.Replace(upper, "-", "_", 1)
-		appendEnv(cgikey, r.Header.Get(key))
-	}
-	return env
+	return (&EnvBuilder{}).Env(start, r)
 }
 
-// ServeHTTP serves an http request using FastCGI
+// ServeHTTP serves an http request using FastCGI. Request bodies of unknown length
+// are held according to DefaultSpool. Local redirects are served the same way.
 func ServeHTTP(s Requester, env []string, w http.ResponseWriter, r *http.Request) {
+	start := env
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeHTTP(s, start, w, r)
+	})
 	env = HTTPEnv(env, r)
+	env, body, cleanup, err := requestBody(env, r, DefaultSpool)
+	if err != nil {
+		serveError(w, r, responseOptions{}, err)
+		return
+	}
+	defer cleanup()
+	serveResponse(w, r, responseOptions{redirect: redirect}, func(stdout, stderr io.Writer) error {
+		return RequestContext(r.Context(), s, env, body, stdout, stderr)
+	})
+}
 
+// requestBody adds CONTENT_LENGTH to env and returns the body to send as stdin,
+// and a function to call when the body is no longer needed.
+func requestBody(env []string, r *http.Request, spool SpoolPolicy) ([]string, io.Reader, func(), error) {
 	var body io.Reader = r.Body
+	cleanup := func() {}
 	// CONTENT_LENGTH is special and important
 	if l := r.Header.Get("Content-length"); l != "" {
+		if n, err := strconv.ParseInt(l, 10, 64); err == nil && spool.MaxBody > 0 && n > spool.MaxBody {
+			return env, nil, cleanup, ErrBodyTooLarge
+		}
 		env = append(env, "CONTENT_LENGTH="+l)
 	} else if r.Body != nil {
 		// Some different transfer-encoding, presumably.
-		// Read the body into a buffer
-		// If there is an error we'll just ignore it for now.
-		buf := bytes.NewBuffer(nil)
-		io.Copy(buf, r.Body)
+		// Spool the body so we know how long it is.
+		spooled, n, spoolCleanup, err := spool.spool(r.Body)
 		r.Body.Close()
-		body = buf
-		env = append(env, fmt.Sprintf("CONTENT_LENGTH=%d", buf.Len()))
+		if err != nil {
+			return env, nil, cleanup, err
+		}
+		body, cleanup = spooled, spoolCleanup
+		env = append(env, fmt.Sprintf("CONTENT_LENGTH=%d", n))
 	} else {
 		env = append(env, "CONTENT_LENGTH=0")
 	}
+	return env, body, cleanup, nil
+}
+
+// responseOptions say how an application's response is sent.
+type responseOptions struct {
+	flush     FlushPolicy
+	flushSize int
+	// redirect handles local redirects. If nil they are sent to the client as 302s.
+	redirect http.Handler
+	// errors sends error responses. If nil DefaultErrorHandler does.
+	errors ErrorHandler
+	// logger gets failures, including those DefaultErrorHandler logs. If nil,
+	// slog.Default() does.
+	logger *slog.Logger
+}
 
+func (opts responseOptions) log() *slog.Logger {
+	if opts.logger == nil {
+		return slog.Default()
+	}
+	return opts.logger
+}
+
+// serveResponse runs a request and sends its output as the http response.
+// If the request fails before the application sends anything, an error response
+// is sent instead. Once anything has been sent, the response is aborted, so that
+// the client can't mistake it for a complete one, unless the error came after all
+// the output; then it is only logged.
+func serveResponse(w http.ResponseWriter, r *http.Request, opts responseOptions, request func(stdout, stderr io.Writer) error) {
+	tw := &trackingWriter{ResponseWriter: w}
 	outreader, outwriter := io.Pipe()
 	stderr := bytes.NewBuffer(nil)
-	done := make(chan struct{})
+	errc := make(chan error, 1)
 	go func() {
-		defer close(done)
-		defer outwriter.Close()
-		err := s.Request(env, body, outwriter, stderr)
-		if err != nil {
-			// There should not be anything in stdout. We should really guard against that.
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		err := request(outwriter, stderr)
+		if outputComplete(err) {
+			outwriter.Close()
+		} else {
+			outwriter.CloseWithError(err)
 		}
+		errc <- err
 	}()
 
 	// Add any headers produced by the application, and skip to the response.
-	ProcessResponse(outreader, w, r)
-	<-done
+	perr := processResponse(outreader, tw, r, opts)
+	// If the client went away there may be output left; don't let the request
+	// block writing it.
+	outreader.Close()
+	err := <-errc
+	if err == nil {
+		err = perr
+	}
+	// Nobody to tell if the client is gone.
+	if err == nil || r.Context().Err() == context.Canceled {
+		return
+	}
+	if tw.wrote && outputComplete(err) {
+		opts.log().Warn("Request failed after its response was sent", "error", err, "method", r.Method, "uri", r.RequestURI)
+		return
+	}
+	if tw.wrote {
+		panic(http.ErrAbortHandler)
+	}
+	serveError(w, r, opts, err)
+}
+
+// outputComplete reports whether err came after the application had sent all its
+// output: it reported a failure, rather than being cut short.
+func outputComplete(err error) bool {
+	var status *AppStatusError
+	var exit *exec.ExitError
+	return errors.As(err, &status) || errors.As(err, &exit) && exit.Exited()
+}
+
+// trackingWriter notes whether anything has been sent.
+type trackingWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (tw *trackingWriter) WriteHeader(code int) {
+	tw.wrote = true
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *trackingWriter) Write(data []byte) (int, error) {
+	tw.wrote = true
+	return tw.ResponseWriter.Write(data)
+}
+
+func (tw *trackingWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *trackingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
 }
 
 // ProcessResponse adds any returned header data to the response header and sends the rest
-// to the response body.
+// to the response body. The body is flushed to the client as it arrives.
+// A Location header without a Status is a redirect, sent to the client as a 302.
 func ProcessResponse(stdout io.Reader, w http.ResponseWriter, r *http.Request) error {
-	bufReader := bufio.NewReader(stdout)
-	mimeReader := textproto.NewReader(bufReader)
-	hdr, err := mimeReader.ReadMIMEHeader()
+	return processResponse(stdout, w, r, responseOptions{})
+}
+
+// cgiHeader is the header block of a CGI response.
+type cgiHeader struct {
+	header    textproto.MIMEHeader
+	code      int
+	status    string // like "404 Not Found", with the application's reason phrase
+	hasStatus bool
+}
+
+// parseStatus parses the value of a Status header.
+func parseStatus(s string) (code int, status string, err error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 3 || (len(s) > 3 && s[3] != ' ') {
+		return 0, "", fmt.Errorf("Bad Status %q", s)
+	}
+	code, err = strconv.Atoi(s[:3])
+	if err != nil || code < 100 {
+		return 0, "", fmt.Errorf("Bad Status %q", s)
+	}
+	reason := ""
+	if len(s) > 3 {
+		reason = strings.TrimSpace(s[4:])
+	}
+	if reason == "" {
+		reason = http.StatusText(code)
+	}
+	return code, strconv.Itoa(code) + " " + reason, nil
+}
+
+// readCGIHeader reads the header block of a CGI response.
+func readCGIHeader(r *bufio.Reader) (*cgiHeader, error) {
+	hdr, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, &MalformedResponseError{Err: err}
+	}
+	h := &cgiHeader{header: hdr, code: http.StatusOK, status: "200 OK"}
+	if len(hdr["Location"]) > 1 {
+		return nil, &MalformedResponseError{Err: errors.New("Multiple Location headers")}
+	}
+	switch vals := hdr["Status"]; {
+	case len(vals) > 1:
+		return nil, &MalformedResponseError{Err: errors.New("Multiple Status headers")}
+	case len(vals) == 1:
+		if h.code, h.status, err = parseStatus(vals[0]); err != nil {
+			return nil, &MalformedResponseError{Err: err}
+		}
+		h.hasStatus = true
+		delete(hdr, "Status")
+	case hdr.Get("Location") != "":
+		h.code, h.status = http.StatusFound, "302 Found"
+	}
+	return h, nil
+}
+
+// processResponse is ProcessResponse with options. The flush policy may be overridden
+// by the application with an X-Accel-Buffering header.
+func processResponse(stdout io.Reader, w http.ResponseWriter, r *http.Request, opts responseOptions) error {
+	h, bufReader, err := readLimitedHeader(stdout, DefaultMaxHeaderBytes)
 	if err != nil {
-		// We got nothing! Assume there is an error. Should be more robust.
 		return err
 	}
-	if err == nil {
-		for k, vals := range hdr {
-			for _, v := range vals {
-				w.Header().Add(k, v)
-			}
+
+	// A local path with no Status and no body is a local redirect.
+	if location := h.header.Get("Location"); !h.hasStatus && opts.redirect != nil && isLocalPath(location) {
+		if _, err := bufReader.Peek(1); err == io.EOF {
+			return localRedirect(opts.redirect, location, w, r)
+		}
+	}
+
+	// A buffered response is read before any headers are set, so that if it fails
+	// the error response doesn't get them.
+	policy := bufferingOverride(h.header, opts.flush)
+	var body []byte
+	if policy == FlushBuffered {
+		if body, err = ioutil.ReadAll(bufReader); err != nil {
+			return err
+		}
+	}
+	for k, vals := range h.header {
+		for _, v := range vals {
+			w.Header().Add(k, v)
 		}
 	}
-	statusCode := http.StatusOK
-	if status := hdr.Get("Status"); status != "" {
-		delete(w.Header(), "Status")
-		// Parse the status code
-		var code int
-		if n, _ := fmt.Sscanf(status, "%d", &code); n == 1 {
-			statusCode = int(code)
+	// The reason phrase can't be passed on; net/http always sends the standard one.
+	statusCode := h.code
+	delete(w.Header(), "X-Accel-Buffering")
+	if policy == FlushBuffered {
+		if w.Header().Get("Content-Length") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
 		}
+		w.WriteHeader(statusCode)
+		w.Write(body)
+		return nil
 	}
 	// Are there other fields we need to rewrite? Probably!
 	w.WriteHeader(statusCode)
-	io.Copy(w, bufReader)
+	io.Copy(newFlushWriter(w, policy, opts.flushSize), bufReader)
 	return nil
 }
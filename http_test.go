@@ -130,7 +130,7 @@ func TestHttp(t *testing.T) {
 			f:        RequesterFunc(brokenRequester),
 			body:     strings.NewReader("This is a test"),
 			status:   500,
-			expected: _brokenReqError + "\n",
+			expected: "Internal Server Error\n", // the details are for the log
 		},
 	}
 	for _, d := range data {
@@ -0,0 +1,151 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// StderrPolicy says what ServeHTTP does with an application's error output.
+type StderrPolicy int
+
+const (
+	// StderrLog logs each line, tagged with the request ID, backend and script.
+	StderrLog StderrPolicy = iota
+	// StderrDrop throws it away.
+	StderrDrop
+	// StderrCollect holds it until the request is over, then logs it as a single
+	// record. If the request failed, it is also attached to the error as a
+	// *StderrError, so that an ErrorHandler can find it with errors.As and show it,
+	// say in development. DefaultErrorHandler and ErrorPages don't.
+	StderrCollect
+)
+
+// MaxStderrLine is the most application error output logged as one record. Longer
+// lines are split, and StderrCollect keeps only this much.
+const MaxStderrLine = 64 << 10
+
+// StderrError is the error for a failed request, with what the application wrote
+// to stderr. Its message is Err's, so the output isn't shown to clients by accident.
+type StderrError struct {
+	Err    error
+	Stderr []byte
+}
+
+func (e *StderrError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StderrError) Unwrap() error {
+	return e.Err
+}
+
+type loggerKey struct{}
+
+// requestLogger returns the logger that goes with r, or slog.Default().
+func requestLogger(r *http.Request) *slog.Logger {
+	if r != nil {
+		if l, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+			return l
+		}
+	}
+	return slog.Default()
+}
+
+var requestSeq uint64
+
+// requestID identifies an http request in logs: by its X-Request-Id header,
+// or failing that a number.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return strconv.FormatUint(atomic.AddUint64(&requestSeq, 1), 10)
+}
+
+// dialerName describes the backend a dialer connects to.
+func dialerName(d Dialer) string {
+	switch d := d.(type) {
+	case fmt.Stringer:
+		return d.String()
+	case *StdinDialer:
+		return d.app
+	}
+	return ""
+}
+
+// envValue returns the value of a variable in env.
+func envValue(env []string, name string) string {
+	for _, e := range env {
+		if k, v, err := parseEnv(e); err == nil && k == name {
+			return v
+		}
+	}
+	return ""
+}
+
+// appStderr takes an application's error output for one request.
+type appStderr struct {
+	policy StderrPolicy
+	logger *slog.Logger
+	buf    []byte
+}
+
+func newAppStderr(policy StderrPolicy, logger *slog.Logger, r *http.Request, backend string, env []string) *appStderr {
+	script := envValue(env, "SCRIPT_FILENAME")
+	if script == "" {
+		script = envValue(env, "SCRIPT_NAME")
+	}
+	logger = logger.With("request_id", requestID(r), "backend", backend, "script", script)
+	return &appStderr{policy: policy, logger: logger}
+}
+
+func (a *appStderr) Write(data []byte) (int, error) {
+	switch a.policy {
+	case StderrDrop:
+	case StderrCollect:
+		if room := MaxStderrLine - len(a.buf); room > 0 {
+			a.buf = append(a.buf, data[:min(len(data), room)]...)
+		}
+	default:
+		a.buf = append(a.buf, data...)
+		for {
+			switch i := bytes.IndexByte(a.buf, '\n'); {
+			case i >= 0 && i <= MaxStderrLine:
+				a.log(a.buf[:i])
+				a.buf = a.buf[i+1:]
+			case len(a.buf) >= MaxStderrLine:
+				a.log(a.buf[:MaxStderrLine])
+				a.buf = a.buf[MaxStderrLine:]
+			default:
+				return len(data), nil
+			}
+		}
+	}
+	return len(data), nil
+}
+
+// log logs some output, if there's anything to it.
+func (a *appStderr) log(data []byte) {
+	data = bytes.TrimRight(data, "\r\n")
+	if len(data) > 0 {
+		a.logger.Warn("Application stderr", "stderr", string(data))
+	}
+}
+
+// done is called with the request's error when it is over. It returns the error to
+// report, with any collected output attached.
+func (a *appStderr) done(err error) error {
+	buf := a.buf
+	a.buf = nil
+	if a.policy != StderrDrop {
+		a.log(buf)
+	}
+	if err != nil && a.policy == StderrCollect && len(buf) > 0 {
+		return &StderrError{Err: err, Stderr: buf}
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// logRecords decodes what a JSON slog handler wrote.
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var recs []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestStderrLog(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		return fakeResponse{stdout: "\r\nok", stderr: "first\r\nsecond\nthird"}
+	})
+	defer app.Close()
+	logs := bytes.NewBuffer(nil)
+	s := NewFCGI(app.Addr())
+	s.Logger = slog.New(slog.NewJSONHandler(logs, nil))
+	s.Env = &EnvBuilder{Script: "/index.php"}
+
+	r := httptest.NewRequest("GET", "/hello", nil)
+	r.Header.Set("X-Request-Id", "abc123")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Body.String() != "ok" {
+		t.Errorf("Got %q", w.Body.String())
+	}
+
+	recs := logRecords(t, logs)
+	var lines []string
+	for _, rec := range recs {
+		lines = append(lines, rec["stderr"].(string))
+		if rec["request_id"] != "abc123" || rec["backend"] != "tcp://"+app.Addr() || rec["script"] != "/index.php" {
+			t.Errorf("Badly tagged record %v", rec)
+		}
+	}
+	if strings.Join(lines, "|") != "first|second|third" {
+		t.Errorf("Logged %q", lines)
+	}
+}
+
+func TestStderrDropAndCollect(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		if req.params["REQUEST_URI"] == "/fail" {
+			return fakeResponse{stderr: "it broke\n", protocolStatus: fcgiOverloaded}
+		}
+		return fakeResponse{stdout: "\r\nok", stderr: "a\nb\n"}
+	})
+	defer app.Close()
+	logs := bytes.NewBuffer(nil)
+	s := NewFCGI(app.Addr())
+	s.Logger = slog.New(slog.NewJSONHandler(logs, nil))
+
+	s.Stderr = StderrDrop
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if logs.Len() != 0 {
+		t.Errorf("Dropped stderr was logged: %s", logs)
+	}
+
+	// Successful requests log what was collected in one go.
+	s.Stderr = StderrCollect
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if recs := logRecords(t, logs); len(recs) != 1 || recs[0]["stderr"] != "a\nb" {
+		t.Errorf("Collected stderr logged as %v", recs)
+	}
+
+	// Failed ones log it too, and hand it to the error handler, which can show it.
+	logs.Reset()
+	s.ErrorHandler = ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request, code int, err error) {
+		var se *StderrError
+		if errors.As(err, &se) {
+			w.WriteHeader(code)
+			w.Write(se.Stderr)
+		}
+	})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/fail", nil))
+	if w.Code != 503 || w.Body.String() != "it broke\n" {
+		t.Errorf("Failed request got %d %q", w.Code, w.Body.String())
+	}
+	if recs := logRecords(t, logs); len(recs) != 1 || recs[0]["stderr"] != "it broke" {
+		t.Errorf("Collected stderr for a failure logged as %v", recs)
+	}
+
+	// The default handler keeps it to itself.
+	s.ErrorHandler = nil
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/fail", nil))
+	if w.Code != 503 || strings.Contains(w.Body.String(), "broke") {
+		t.Errorf("Default error page was %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestStderrLongLines(t *testing.T) {
+	logs := bytes.NewBuffer(nil)
+	a := newAppStderr(StderrLog, slog.New(slog.NewJSONHandler(logs, nil)), httptest.NewRequest("GET", "/", nil), "", nil)
+	a.Write(bytes.Repeat([]byte("x"), MaxStderrLine+10))
+	a.Write([]byte("\n"))
+	a.done(nil)
+	recs := logRecords(t, logs)
+	if len(recs) != 2 || len(recs[0]["stderr"].(string)) != MaxStderrLine || len(recs[1]["stderr"].(string)) != 10 {
+		t.Errorf("Long line logged as %d records", len(recs))
+	}
+}
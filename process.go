@@ -0,0 +1,376 @@
+package gofcgisrv
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ProcessMode says how a ProcessManager decides how many children to run.
+type ProcessMode int
+
+const (
+	// ProcessStatic always runs MaxChildren children.
+	ProcessStatic ProcessMode = iota
+	// ProcessDynamic runs at least MinSpareChildren, and more as connections
+	// need them, up to MaxChildren.
+	ProcessDynamic
+	// ProcessOnDemand runs children only while there are connections for them.
+	ProcessOnDemand
+)
+
+// Defaults for a ProcessManager's backoff after a child crashes.
+const (
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+// DefaultStopTimeout is the StopTimeout used if none is set.
+const DefaultStopTimeout = 10 * time.Second
+
+var errManagerClosed = errors.New("Process manager is closed")
+
+// ProcessManager runs FastCGI application processes that all accept on one listening
+// socket, passed to them as stdin, the way spawn-fcgi and php-fpm do.
+// It is a Dialer. Set its fields before calling Start.
+//
+// Children that exit are started again; crashes are retried with exponential backoff.
+// Since children share the socket, the manager can't tell which one is handling a
+// connection. It only ever stops children when no connections are open.
+type ProcessManager struct {
+	App  string
+	Args []string
+	// Env is added to the manager's own environment for the children.
+	Env []string
+	// Where the children's output goes. If nil, os.Stdout and os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	Mode             ProcessMode
+	MaxChildren      int
+	MinSpareChildren int
+	// IdleTimeout is how long there must be no open connections before
+	// dynamic or on-demand children beyond the minimum are stopped.
+	IdleTimeout time.Duration
+	// MaxRequests, if nonzero, is passed to the children as PHP_FCGI_MAX_REQUESTS,
+	// so they exit after that many requests and are replaced.
+	MaxRequests int
+
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// StopTimeout is how long children asked to stop with SIGTERM get to finish
+	// what they are doing before they are killed. Zero means DefaultStopTimeout.
+	StopTimeout time.Duration
+
+	lock     sync.Mutex
+	listener net.Listener
+	socket   *os.File
+	filename string
+	children map[*exec.Cmd]bool
+	open     int
+	// When the last connection closed
+	idleSince time.Time
+	failures  int
+	// No children are started before this, after a crash.
+	backoffUntil time.Time
+	started      bool
+	closed       bool
+	wg           sync.WaitGroup
+}
+
+// NewProcessManager creates a manager for a static pool of children running app.
+func NewProcessManager(children int, app string, args ...string) *ProcessManager {
+	return &ProcessManager{App: app, Args: args, Mode: ProcessStatic, MaxChildren: children}
+}
+
+// listenStdinSocket creates a Unix socket suitable for handing to a child as stdin.
+func listenStdinSocket() (net.Listener, *os.File, string, error) {
+	// We'll use the high-level net API, creating a listener that does all sorts
+	// of socket stuff, getting its file, and passing that (really just for its FD)
+	// to the child processes.
+	// We'll rely on crypt/rand to get a unique filename for the socket.
+	tmpdir := os.TempDir()
+	rnd := make([]byte, 8)
+	n, err := rand.Read(rnd)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	basename := fmt.Sprintf("fcgi%x", rnd[:n])
+	filename := path.Join(tmpdir, basename)
+
+	listener, err := net.Listen("unix", filename)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	socket, err := listener.(*net.UnixListener).File()
+	if err != nil {
+		listener.Close()
+		return nil, nil, "", err
+	}
+	return listener, socket, filename, nil
+}
+
+// Start creates the socket and the initial children.
+func (pm *ProcessManager) Start() error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if pm.closed {
+		return errManagerClosed
+	}
+	if pm.started {
+		return nil
+	}
+	listener, socket, filename, err := listenStdinSocket()
+	if err != nil {
+		return err
+	}
+	pm.listener, pm.socket, pm.filename = listener, socket, filename
+	pm.children = make(map[*exec.Cmd]bool)
+	pm.started = true
+	if err := pm.scale(); err != nil {
+		// Leave things as they were, so that the next Start tries again.
+		pm.shutdown()
+		pm.started, pm.filename, pm.children = false, "", nil
+		return err
+	}
+	return nil
+}
+
+// Dial connects to the children, starting the manager if need be.
+func (pm *ProcessManager) Dial() (net.Conn, error) {
+	return pm.DialContext(context.Background())
+}
+
+func (pm *ProcessManager) DialContext(ctx context.Context) (net.Conn, error) {
+	if err := pm.Start(); err != nil {
+		return nil, err
+	}
+	pm.lock.Lock()
+	if pm.closed {
+		pm.lock.Unlock()
+		return nil, errManagerClosed
+	}
+	pm.open++
+	// Not being able to start more children isn't fatal; there may be some already.
+	pm.scale()
+	filename := pm.filename
+	pm.lock.Unlock()
+
+	var nd net.Dialer
+	c, err := nd.DialContext(ctx, "unix", filename)
+	if err != nil {
+		pm.connClosed()
+		return nil, err
+	}
+	return &managedConn{Conn: c, pm: pm}, nil
+}
+
+// NumChildren returns the number of children running.
+func (pm *ProcessManager) NumChildren() int {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	return len(pm.children)
+}
+
+// Close stops all the children and removes the socket. It waits for the children
+// to exit, which may take up to StopTimeout.
+func (pm *ProcessManager) Close() error {
+	pm.lock.Lock()
+	pm.closed = true
+	pm.shutdown()
+	pm.lock.Unlock()
+	pm.wg.Wait()
+	return nil
+}
+
+// shutdown must be called with the lock held.
+func (pm *ProcessManager) shutdown() {
+	for cmd := range pm.children {
+		// As in connClosed, watch will leave it be.
+		delete(pm.children, cmd)
+		pm.stopChild(cmd)
+	}
+	if pm.socket != nil {
+		pm.socket.Close()
+		pm.socket = nil
+	}
+	if pm.listener != nil {
+		// This removes the socket file.
+		pm.listener.Close()
+		pm.listener = nil
+	}
+}
+
+// stopChild asks a child to exit with SIGTERM, and kills it if it is still
+// running after StopTimeout.
+func (pm *ProcessManager) stopChild(cmd *exec.Cmd) {
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		// Already gone, or there's no such signal here.
+		cmd.Process.Kill()
+		return
+	}
+	timeout := pm.StopTimeout
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
+	}
+	// Once the child has been waited for, Kill does nothing.
+	time.AfterFunc(timeout, func() { cmd.Process.Kill() })
+}
+
+// target is how many children there should be.
+// Should only be called if lock is held.
+func (pm *ProcessManager) target() int {
+	n := pm.MaxChildren
+	switch pm.Mode {
+	case ProcessDynamic:
+		n = pm.open + pm.MinSpareChildren
+	case ProcessOnDemand:
+		n = pm.open
+	}
+	if n > pm.MaxChildren {
+		n = pm.MaxChildren
+	}
+	return n
+}
+
+// scale starts children until there are enough.
+// Should only be called if lock is held.
+func (pm *ProcessManager) scale() error {
+	if time.Now().Before(pm.backoffUntil) {
+		return nil
+	}
+	for pm.started && !pm.closed && len(pm.children) < pm.target() {
+		if err := pm.spawn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spawn starts a child.
+// Should only be called if lock is held.
+func (pm *ProcessManager) spawn() error {
+	cmd := exec.Command(pm.App, pm.Args...)
+	cmd.Env = append(os.Environ(), pm.Env...)
+	if pm.MaxRequests > 0 {
+		cmd.Env = append(cmd.Env, "PHP_FCGI_MAX_REQUESTS="+strconv.Itoa(pm.MaxRequests))
+	}
+	cmd.Stdin = pm.socket
+	cmd.Stdout = pm.Stdout
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	cmd.Stderr = pm.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pm.children[cmd] = true
+	pm.wg.Add(1)
+	go pm.watch(cmd, time.Now())
+	return nil
+}
+
+// watch waits for a child to exit and replaces it if it is still wanted.
+func (pm *ProcessManager) watch(cmd *exec.Cmd, started time.Time) {
+	defer pm.wg.Done()
+	err := cmd.Wait()
+	ran := time.Since(started)
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if !pm.children[cmd] {
+		// Stopped on purpose.
+		return
+	}
+	delete(pm.children, cmd)
+	if pm.closed {
+		return
+	}
+	minBackoff, maxBackoff := pm.MinBackoff, pm.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	if err == nil || ran >= maxBackoff {
+		// A clean exit is a child recycling itself, and one that ran a good
+		// while was healthy enough.
+		pm.failures = 0
+	}
+	if err == nil {
+		pm.scale()
+		return
+	}
+	pm.failures++
+	delay := minBackoff
+	for i := 1; i < pm.failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	pm.backoffUntil = time.Now().Add(delay)
+	time.AfterFunc(delay, func() {
+		pm.lock.Lock()
+		defer pm.lock.Unlock()
+		pm.scale()
+	})
+}
+
+// connClosed notes that a connection has closed, and stops extra children
+// once no connections have been open for IdleTimeout.
+func (pm *ProcessManager) connClosed() {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.open--
+	if pm.open > 0 || pm.Mode == ProcessStatic {
+		return
+	}
+	pm.idleSince = time.Now()
+	time.AfterFunc(pm.IdleTimeout, func() {
+		pm.lock.Lock()
+		defer pm.lock.Unlock()
+		if pm.open > 0 || pm.closed || time.Since(pm.idleSince) < pm.IdleTimeout {
+			return
+		}
+		extra := len(pm.children) - pm.target()
+		for cmd := range pm.children {
+			if extra <= 0 {
+				break
+			}
+			// The child is gone as far as we're concerned; watch will see it
+			// exit and leave it be.
+			delete(pm.children, cmd)
+			pm.stopChild(cmd)
+			extra--
+		}
+	})
+}
+
+// managedConn tells its ProcessManager when it is closed.
+type managedConn struct {
+	net.Conn
+	pm   *ProcessManager
+	once sync.Once
+}
+
+func (c *managedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.pm.connClosed)
+	return err
+}
@@ -0,0 +1,246 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess isn't a real test. It is a FastCGI application for the
+// process manager tests to run, accepting on stdin.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GOFCGISRV_HELPER") != "1" {
+		return
+	}
+	maxRequests, _ := strconv.Atoi(os.Getenv("PHP_FCGI_MAX_REQUESTS"))
+	// On SIGTERM, either carry on or say so in the named file and exit.
+	switch term := os.Getenv("GOFCGISRV_HELPER_TERM"); term {
+	case "":
+	case "ignore":
+		signal.Ignore(syscall.SIGTERM)
+	default:
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGTERM)
+		go func() {
+			<-c
+			os.WriteFile(term, []byte("stopped"), 0644)
+			os.Exit(0)
+		}()
+	}
+	var served int32
+	fcgi.Serve(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/crash" {
+			os.Exit(1)
+		}
+		fmt.Fprintf(w, "%d", os.Getpid())
+		if n := atomic.AddInt32(&served, 1); maxRequests > 0 && int(n) >= maxRequests {
+			// Exit once the response is out, the way php-cgi does.
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				os.Exit(0)
+			}()
+		}
+	}))
+	os.Exit(0)
+}
+
+func helperManager(mode ProcessMode, children int) *ProcessManager {
+	pm := NewProcessManager(children, os.Args[0], "-test.run=^TestHelperProcess$")
+	pm.Mode = mode
+	// The race detector otherwise makes every exit take a second.
+	pm.Env = []string{"GOFCGISRV_HELPER=1", "GORACE=atexit_sleep_ms=0"}
+	pm.MinBackoff = 10 * time.Millisecond
+	return pm
+}
+
+// helperGet requests path from the helper and returns the pid that answered.
+func helperGet(t *testing.T, s Requester, path string) string {
+	env := []string{"REQUEST_METHOD=GET", "SERVER_PROTOCOL=HTTP/1.1", "REQUEST_URI=" + path, "CONTENT_LENGTH=0"}
+	var stdout, stderr bytes.Buffer
+	s.Request(env, strings.NewReader(""), &stdout, &stderr)
+	out := stdout.String()
+	if idx := strings.Index(out, "\r\n\r\n"); idx >= 0 {
+		return out[idx+4:]
+	}
+	return ""
+}
+
+func waitForChildren(pm *ProcessManager, n int) bool {
+	for i := 0; i < 200; i++ {
+		if pm.NumChildren() == n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestProcessManagerStatic(t *testing.T) {
+	pm := helperManager(ProcessStatic, 2)
+	if err := pm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+	if n := pm.NumChildren(); n != 2 {
+		t.Errorf("%d children, not 2", n)
+	}
+	s := NewFCGIDialer(pm)
+	if pid := helperGet(t, s, "/"); pid == "" {
+		t.Errorf("No response")
+	}
+
+	// A crashed child is replaced.
+	helperGet(t, s, "/crash")
+	time.Sleep(50 * time.Millisecond)
+	if !waitForChildren(pm, 2) {
+		t.Errorf("%d children after a crash, not 2", pm.NumChildren())
+	}
+	if pid := helperGet(t, s, "/"); pid == "" {
+		t.Errorf("No response after a crash")
+	}
+
+	pm.Close()
+	if n := pm.NumChildren(); n != 0 {
+		t.Errorf("%d children after Close", n)
+	}
+	if _, err := pm.Dial(); err == nil {
+		t.Errorf("Dial succeeded after Close")
+	}
+}
+
+func TestProcessManagerStartFails(t *testing.T) {
+	pm := NewProcessManager(2, filepath.Join(t.TempDir(), "missing"))
+	defer pm.Close()
+	for i := 0; i < 2; i++ {
+		if err := pm.Start(); err == nil {
+			t.Errorf("Start %d succeeded", i)
+		}
+	}
+	if _, err := pm.Dial(); err == nil {
+		t.Errorf("Dial succeeded")
+	}
+	if n := pm.NumChildren(); n != 0 {
+		t.Errorf("%d children", n)
+	}
+}
+
+func TestProcessManagerStop(t *testing.T) {
+	// Children are asked to stop...
+	file := filepath.Join(t.TempDir(), "stopped")
+	pm := helperManager(ProcessStatic, 1)
+	pm.Env = append(pm.Env, "GOFCGISRV_HELPER_TERM="+file)
+	if pid := helperGet(t, NewFCGIDialer(pm), "/"); pid == "" {
+		t.Fatal("No response")
+	}
+	pm.Close()
+	if data, _ := os.ReadFile(file); string(data) != "stopped" {
+		t.Errorf("Child wasn't sent SIGTERM")
+	}
+
+	// ...and killed if they won't.
+	pm = helperManager(ProcessStatic, 1)
+	pm.Env = append(pm.Env, "GOFCGISRV_HELPER_TERM=ignore")
+	pm.StopTimeout = 100 * time.Millisecond
+	if pid := helperGet(t, NewFCGIDialer(pm), "/"); pid == "" {
+		t.Fatal("No response")
+	}
+	start := time.Now()
+	pm.Close()
+	if d := time.Since(start); d < pm.StopTimeout || d > 5*time.Second {
+		t.Errorf("Stubborn child took %v to stop", d)
+	}
+	if n := pm.NumChildren(); n != 0 {
+		t.Errorf("%d children after Close", n)
+	}
+}
+
+func TestProcessManagerMaxRequests(t *testing.T) {
+	pm := helperManager(ProcessStatic, 1)
+	pm.MaxRequests = 2
+	defer pm.Close()
+	s := NewFCGIDialer(pm)
+	pids := make(map[string]bool)
+	for i := 0; i < 6; i++ {
+		pid := helperGet(t, s, "/")
+		if pid == "" {
+			t.Fatalf("No response to request %d", i)
+		}
+		pids[pid] = true
+		if i%2 == 1 {
+			// Let the child exit and be replaced.
+			time.Sleep(50 * time.Millisecond)
+			waitForChildren(pm, 1)
+		}
+	}
+	if len(pids) != 3 {
+		t.Errorf("%d different children served 6 requests", len(pids))
+	}
+}
+
+func TestProcessManagerDynamic(t *testing.T) {
+	pm := helperManager(ProcessDynamic, 3)
+	pm.MinSpareChildren = 1
+	pm.IdleTimeout = 50 * time.Millisecond
+	if err := pm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+	if n := pm.NumChildren(); n != 1 {
+		t.Errorf("%d children before any requests, not 1", n)
+	}
+
+	// Each connection gets a spare, up to MaxChildren.
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := pm.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	if n := pm.NumChildren(); n != 3 {
+		t.Errorf("%d children with 3 connections, not 3", n)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	if !waitForChildren(pm, 1) {
+		t.Errorf("%d children after idling, not 1", pm.NumChildren())
+	}
+	if pid := helperGet(t, NewFCGIDialer(pm), "/"); pid == "" {
+		t.Errorf("No response")
+	}
+}
+
+func TestProcessManagerOnDemand(t *testing.T) {
+	pm := helperManager(ProcessOnDemand, 4)
+	pm.IdleTimeout = 50 * time.Millisecond
+	if err := pm.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+	if n := pm.NumChildren(); n != 0 {
+		t.Errorf("%d children before any requests", n)
+	}
+	s := NewFCGIDialer(pm)
+	if pid := helperGet(t, s, "/"); pid == "" {
+		t.Errorf("No response")
+	}
+	if n := pm.NumChildren(); n != 1 {
+		t.Errorf("%d children after a request, not 1", n)
+	}
+	if !waitForChildren(pm, 0) {
+		t.Errorf("%d children after idling, not 0", pm.NumChildren())
+	}
+}
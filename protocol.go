@@ -35,10 +35,15 @@ const (
 	fcgiFilter
 )
 
+// Flags for BeginRequest
+const (
+	fcgiKeepConn byte = 1
+)
+
 // ProtocolStatus
 const (
 	fcgiRequestComplete uint8 = iota
-	fcgiCanMpxConn
+	fcgiCantMpxConn
 	fcgiOverloaded
 	fcgiUnknownRole
 )
@@ -50,6 +55,18 @@ const (
 	fcgiMpxsConns = "FCGI_MPXS_CONNS"
 )
 
+// Filter variables
+const (
+	fcgiDataLastMod = "FCGI_DATA_LAST_MOD"
+	fcgiDataLength  = "FCGI_DATA_LENGTH"
+)
+
+// The largest request id a connection can hand out.
+const maxRequestId = 0xffff
+
+// The most content a single record can carry.
+const maxRecordContent = 0xffff
+
 var pad [7]byte
 
 type record struct {
@@ -60,28 +77,24 @@ type record struct {
 
 func writeRecord(w io.Writer, rec record) error {
 	clength := len(rec.Content)
-	if clength > 0xffff {
+	if clength > maxRecordContent {
 		return errors.New("Content too large for record")
 	}
 	// Padding
 	plength := (-uint16(clength)) & 7
-	// Should we check for failure? Let's not bother for the first set, as
-	// we'll always be doing this into a buffer.
-	binary.Write(w, binary.BigEndian, fcgiVersion)
-	binary.Write(w, binary.BigEndian, rec.Type)
-	binary.Write(w, binary.BigEndian, rec.Id)
-	binary.Write(w, binary.BigEndian, uint16(clength))
-	binary.Write(w, binary.BigEndian, uint8(plength))
-	w.Write([]byte{0})
-	if _, err := w.Write(rec.Content); err != nil {
-		return err
-	}
-	if plength != 0 {
-		if _, err := w.Write(pad[:plength]); err != nil {
-			return err
-		}
-	}
-	return nil
+	// Build the whole record and write it at once, so that records from
+	// requests sharing a connection are not interleaved.
+	buffer := bytes.NewBuffer(make([]byte, 0, 8+clength+int(plength)))
+	binary.Write(buffer, binary.BigEndian, fcgiVersion)
+	binary.Write(buffer, binary.BigEndian, rec.Type)
+	binary.Write(buffer, binary.BigEndian, rec.Id)
+	binary.Write(buffer, binary.BigEndian, uint16(clength))
+	binary.Write(buffer, binary.BigEndian, uint8(plength))
+	buffer.WriteByte(0)
+	buffer.Write(rec.Content)
+	buffer.Write(pad[:plength])
+	_, err := w.Write(buffer.Bytes())
+	return err
 }
 
 func _read(r io.Reader, data interface{}) error {
@@ -110,18 +123,20 @@ func readRecord(r io.Reader) (record, error) {
 	if err := _read(r, &plength); err != nil {
 		return rec, err
 	}
-	// Skip one byte
-	if _, err := r.Read(pad[:1]); err != nil {
+	// Skip one byte. The padding buffer is local, as many connections may
+	// be reading at once.
+	var skip [8]byte
+	if _, err := io.ReadFull(r, skip[:1]); err != nil {
 		return rec, err
 	}
 	if clength != 0 {
 		rec.Content = make([]byte, clength)
-		if _, err := r.Read(rec.Content); err != nil {
+		if _, err := io.ReadFull(r, rec.Content); err != nil {
 			return rec, err
 		}
 	}
 	if plength != 0 {
-		if _, err := r.Read(pad[:plength]); err != nil {
+		if _, err := io.ReadFull(r, skip[:plength]); err != nil {
 			return rec, err
 		}
 	}
@@ -208,3 +223,10 @@ func writeBeginRequest(w io.Writer, reqId requestId, role uint16, flags byte) er
 	content := [8]byte{byte(role >> 8), byte(role & 0xff), flags, 0, 0, 0, 0, 0}
 	return writeRecord(w, record{fcgiBeginRequest, reqId, content[:]})
 }
+
+func readEndRequest(content []byte) (appStatus uint32, protocolStatus uint8, err error) {
+	if len(content) < 5 {
+		return 0, 0, errors.New("END_REQUEST record too short")
+	}
+	return binary.BigEndian.Uint32(content), content[4], nil
+}
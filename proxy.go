@@ -0,0 +1,191 @@
+package gofcgisrv
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ProxyHeader says where trusted proxies put the client's address.
+type ProxyHeader int
+
+const (
+	// ProxyXForwardedFor uses X-Forwarded-For, with X-Forwarded-Proto and X-Forwarded-Host.
+	ProxyXForwardedFor ProxyHeader = iota
+	// ProxyForwarded uses the Forwarded header of RFC 7239.
+	ProxyForwarded
+	// ProxyXRealIP uses X-Real-IP, with X-Forwarded-Proto and X-Forwarded-Host.
+	ProxyXRealIP
+)
+
+// proxyHeaders are the headers proxies use to describe the client. They are
+// not passed on from untrusted peers.
+var proxyHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded", "X-Real-Ip"}
+
+// TrustedProxies says which peers are believed about who the client really is.
+// The original peer address is passed as REALIP_REMOTE_ADDR and REALIP_REMOTE_PORT.
+type TrustedProxies struct {
+	// Networks are the addresses of trusted proxies.
+	Networks []*net.IPNet
+	// Header is where they put the client's address.
+	Header ProxyHeader
+	// Hops, if nonzero, is how many proxies a request passes through, so that the
+	// client is that many entries from the end of the list. Otherwise the client is the
+	// last entry that isn't itself a trusted proxy.
+	Hops int
+}
+
+// ParseTrustedProxies returns TrustedProxies for the given CIDRs or plain IP addresses.
+func ParseTrustedProxies(header ProxyHeader, cidrs ...string) (*TrustedProxies, error) {
+	p := &TrustedProxies{Header: header}
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		p.Networks = append(p.Networks, network)
+	}
+	return p, nil
+}
+
+// trusts reports whether addr is a trusted proxy.
+func (p *TrustedProxies) trusts(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// A forwardedHop is one proxy's account of where a request came from.
+type forwardedHop struct {
+	addr, port  string
+	proto, host string
+}
+
+// parseHopAddr splits a forwarded address, which may be quoted, bracketed, or have a port.
+// ok is false if there is no IP address, as for "unknown" or an obfuscated name.
+func parseHopAddr(s string) (addr, port string, ok bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, p, err := net.SplitHostPort(s); err == nil {
+		s, port = host, p
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if net.ParseIP(s) == nil {
+		return "", "", false
+	}
+	return s, port, true
+}
+
+// lastValue returns the last comma-separated value of a header, which the
+// nearest proxy will have set.
+func lastValue(h http.Header, name string) string {
+	vals := h.Values(name)
+	if len(vals) == 0 {
+		return ""
+	}
+	parts := strings.Split(vals[len(vals)-1], ",")
+	return strings.TrimSpace(parts[len(parts)-1])
+}
+
+// hops returns the forwarding chain, client first.
+func (p *TrustedProxies) hops(h http.Header) []forwardedHop {
+	var hops []forwardedHop
+	switch p.Header {
+	case ProxyForwarded:
+		for _, v := range h.Values("Forwarded") {
+			for _, elem := range strings.Split(v, ",") {
+				var hop forwardedHop
+				for _, pair := range strings.Split(elem, ";") {
+					idx := strings.Index(pair, "=")
+					if idx < 0 {
+						continue
+					}
+					value := strings.Trim(strings.TrimSpace(pair[idx+1:]), `"`)
+					switch strings.ToLower(strings.TrimSpace(pair[:idx])) {
+					case "for":
+						hop.addr = value
+					case "proto":
+						hop.proto = strings.ToLower(value)
+					case "host":
+						hop.host = value
+					}
+				}
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	case ProxyXRealIP:
+		if v := h.Get("X-Real-Ip"); v != "" {
+			hops = append(hops, forwardedHop{addr: v})
+		}
+	default:
+		for _, v := range h.Values("X-Forwarded-For") {
+			for _, addr := range strings.Split(v, ",") {
+				hops = append(hops, forwardedHop{addr: addr})
+			}
+		}
+	}
+	if len(hops) > 0 {
+		last := &hops[len(hops)-1]
+		last.proto = strings.ToLower(lastValue(h, "X-Forwarded-Proto"))
+		last.host = lastValue(h, "X-Forwarded-Host")
+	}
+	return hops
+}
+
+// client returns what the proxies say about the client of a request from a trusted peer.
+// ok is false if they say nothing usable.
+func (p *TrustedProxies) client(h http.Header) (client forwardedHop, ok bool) {
+	hops := p.hops(h)
+	if len(hops) == 0 {
+		return client, false
+	}
+	i := 0
+	if p.Hops > 0 {
+		if i = len(hops) - p.Hops; i < 0 {
+			i = 0
+		}
+	} else {
+		for i = len(hops) - 1; i > 0; i-- {
+			if addr, _, ok := parseHopAddr(hops[i].addr); !ok || !p.trusts(addr) {
+				break
+			}
+		}
+	}
+	client = hops[i]
+	if p.Header != ProxyForwarded {
+		// The headers besides the address list describe the whole chain.
+		client.proto, client.host = hops[len(hops)-1].proto, hops[len(hops)-1].host
+	}
+	client.addr, client.port, ok = parseHopAddr(client.addr)
+	return client, ok
+}
+
+// stripProxyHeaders returns h without the headers a proxy would set. They are
+// matched by variable name, so spellings like X_Forwarded_For go too.
+func stripProxyHeaders(h http.Header) http.Header {
+	vars := make(map[string]bool, len(proxyHeaders))
+	for _, name := range proxyHeaders {
+		vars[headerVar(name)] = true
+	}
+	h = h.Clone()
+	for key := range h {
+		if vars[headerVar(key)] {
+			delete(h, key)
+		}
+	}
+	return h
+}
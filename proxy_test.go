@@ -0,0 +1,96 @@
+package gofcgisrv
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	xff, err := ParseTrustedProxies(ProxyXForwardedFor, "10.0.0.0/8", "192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fwd, _ := ParseTrustedProxies(ProxyForwarded, "10.0.0.0/8")
+	realIP, _ := ParseTrustedProxies(ProxyXRealIP, "10.0.0.0/8")
+	hops, _ := ParseTrustedProxies(ProxyXForwardedFor, "10.0.0.0/8")
+	hops.Hops = 2
+	if _, err := ParseTrustedProxies(ProxyForwarded, "not an address"); err == nil {
+		t.Errorf("Bad CIDR was accepted")
+	}
+
+	data := []struct {
+		proxies *TrustedProxies
+		peer    string
+		headers map[string]string
+		want    map[string]string
+	}{
+		// A trusted balancer, which was itself sent a forged address.
+		{xff, "10.1.2.3:5000", map[string]string{
+			"X-Forwarded-For":   "6.6.6.6, 203.0.113.9, 10.9.9.9",
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "www.example.com",
+		}, map[string]string{
+			"REMOTE_ADDR":          "203.0.113.9",
+			"REMOTE_PORT":          "",
+			"REALIP_REMOTE_ADDR":   "10.1.2.3",
+			"REALIP_REMOTE_PORT":   "5000",
+			"HTTPS":                "on",
+			"SERVER_NAME":          "www.example.com",
+			"SERVER_PORT":          "443",
+			"HTTP_X_FORWARDED_FOR": "6.6.6.6, 203.0.113.9, 10.9.9.9",
+		}},
+		// Counting hops instead.
+		{hops, "10.1.2.3:5000", map[string]string{
+			"X-Forwarded-For": "6.6.6.6, 203.0.113.9, 10.9.9.9",
+		}, map[string]string{
+			"REMOTE_ADDR": "203.0.113.9",
+		}},
+		{fwd, "10.1.2.3:5000", map[string]string{
+			"Forwarded": `for="[2001:db8::1]:4711";proto=https;host=example.org, for=10.2.2.2`,
+		}, map[string]string{
+			"REMOTE_ADDR": "2001:db8::1",
+			"REMOTE_PORT": "4711",
+			"HTTPS":       "on",
+			"SERVER_NAME": "example.org",
+		}},
+		{realIP, "10.1.2.3:5000", map[string]string{
+			"X-Real-Ip": "198.51.100.7",
+		}, map[string]string{
+			"REMOTE_ADDR": "198.51.100.7",
+		}},
+		// Untrusted peers don't get to say, and their headers are dropped.
+		{xff, "203.0.113.9:6000", map[string]string{
+			"X-Forwarded-For":   "10.1.1.1",
+			"X-Forwarded-Proto": "https",
+		}, map[string]string{
+			"REMOTE_ADDR":            "203.0.113.9",
+			"REMOTE_PORT":            "6000",
+			"REALIP_REMOTE_ADDR":     "",
+			"HTTPS":                  "",
+			"HTTP_X_FORWARDED_FOR":   "",
+			"HTTP_X_FORWARDED_PROTO": "",
+		}},
+		// Including when spelled with underscores.
+		{xff, "203.0.113.9:6000", map[string]string{
+			"X_Forwarded_For": "10.1.1.1",
+			"x_real_ip":       "10.1.1.2",
+		}, map[string]string{
+			"REMOTE_ADDR":          "203.0.113.9",
+			"HTTP_X_FORWARDED_FOR": "",
+			"HTTP_X_REAL_IP":       "",
+		}},
+	}
+	for i, d := range data {
+		r := httptest.NewRequest("GET", "http://internal/", nil)
+		r.RemoteAddr = d.peer
+		for k, v := range d.headers {
+			r.Header.Set(k, v)
+		}
+		env := envToMap((&EnvBuilder{Proxies: d.proxies}).Env(nil, r))
+		for k, v := range d.want {
+			if env[k] != v {
+				t.Errorf("%d: %s was %q, not %q", i, k, env[k], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package gofcgisrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// QueueFullError means a request was turned away because MaxQueue requests were
+// already waiting.
+type QueueFullError struct {
+	Depth      int
+	RetryAfter time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("FastCGI request queue is full (%d waiting)", e.Depth)
+}
+
+// QueueTimeoutError means a request waited QueueTimeout without getting a connection.
+type QueueTimeoutError struct {
+	Waited     time.Duration
+	RetryAfter time.Duration
+}
+
+func (e *QueueTimeoutError) Error() string {
+	return fmt.Sprintf("FastCGI request timed out after waiting %v", e.Waited)
+}
+
+// IsOverloaded reports whether err means the application, or our queue for it,
+// was too busy to take the request. Retrying later may work.
+func IsOverloaded(err error) bool {
+	var overloaded *OverloadedError
+	var full *QueueFullError
+	var timeout *QueueTimeoutError
+	return errors.As(err, &overloaded) || errors.As(err, &full) || errors.As(err, &timeout)
+}
+
+// retryAfter returns how long a client should be told to wait after err.
+func retryAfter(err error) time.Duration {
+	var full *QueueFullError
+	var timeout *QueueTimeoutError
+	switch {
+	case errors.As(err, &full):
+		return full.RetryAfter
+	case errors.As(err, &timeout):
+		return timeout.RetryAfter
+	}
+	return 0
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose requests are given priority p when waiting
+// for an FCGIRequester. Higher priorities go first; the default is 0.
+func WithPriority(ctx context.Context, p int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priority(ctx context.Context) int {
+	p, _ := ctx.Value(priorityKey{}).(int)
+	return p
+}
+
+// RequesterStats is a snapshot of an FCGIRequester's load.
+type RequesterStats struct {
+	Active int // requests in progress
+	Queued int // requests waiting for a slot
+	Conns  int // open connections, busy or idle
+
+	QueueWaits    uint64        // requests that have had to wait
+	QueueWaitTime time.Duration // total time they waited
+	Rejected      uint64        // requests turned away by MaxQueue or QueueTimeout
+}
+
+// Stats returns a snapshot of the requester's load.
+func (s *FCGIRequester) Stats() RequesterStats {
+	s.reqLock.Lock()
+	defer s.reqLock.Unlock()
+	stats := s.stats
+	stats.Active = s.numRequests()
+	stats.Queued = len(s.queue)
+	stats.Conns = len(s.connections)
+	return stats
+}
+
+// A waiter is a request in the queue.
+type waiter struct {
+	priority int
+	seq      uint64
+}
+
+// queueHead returns the waiter that should go next.
+// Should only be called if reqLock is held.
+func (s *FCGIRequester) queueHead() *waiter {
+	var head *waiter
+	for _, w := range s.queue {
+		if head == nil || w.priority > head.priority || (w.priority == head.priority && w.seq < head.seq) {
+			head = w
+		}
+	}
+	return head
+}
+
+// dequeue removes w from the queue and lets the rest see if they are next.
+// Should only be called if reqLock is held.
+func (s *FCGIRequester) dequeue(w *waiter) {
+	for i, qw := range s.queue {
+		if qw == w {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	s.reqCond.Broadcast()
+}
+
+// waitForSlot blocks until a request may start, in priority order.
+// Should only be called if reqLock is held.
+func (s *FCGIRequester) waitForSlot(ctx context.Context) error {
+	if s.numRequests() < s.MaxRequests && len(s.queue) == 0 {
+		return nil
+	}
+	if s.MaxQueue > 0 && len(s.queue) >= s.MaxQueue {
+		s.stats.Rejected++
+		return &QueueFullError{Depth: len(s.queue), RetryAfter: s.RetryAfter}
+	}
+
+	start := time.Now()
+	w := &waiter{priority: priority(ctx), seq: s.queueSeq}
+	s.queueSeq++
+	s.queue = append(s.queue, w)
+	wake := func() {
+		s.reqLock.Lock()
+		s.reqCond.Broadcast()
+		s.reqLock.Unlock()
+	}
+	stop := context.AfterFunc(ctx, wake)
+	defer stop()
+	if s.QueueTimeout > 0 {
+		t := time.AfterFunc(s.QueueTimeout, wake)
+		defer t.Stop()
+	}
+
+	for s.numRequests() >= s.MaxRequests || s.queueHead() != w {
+		if s.closing {
+			s.dequeue(w)
+			return ErrClosed
+		}
+		if err := ctx.Err(); err != nil {
+			s.dequeue(w)
+			return err
+		}
+		if waited := time.Since(start); s.QueueTimeout > 0 && waited >= s.QueueTimeout {
+			s.dequeue(w)
+			s.stats.Rejected++
+			return &QueueTimeoutError{Waited: waited, RetryAfter: s.RetryAfter}
+		}
+		s.reqCond.Wait()
+	}
+	s.dequeue(w)
+	s.stats.QueueWaits++
+	s.stats.QueueWaitTime += time.Since(start)
+	return nil
+}
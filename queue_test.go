@@ -0,0 +1,125 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingApp answers requests with their ORDER parameter once released.
+func blockingApp(t *testing.T) (*fakeApp, chan struct{}) {
+	release := make(chan struct{})
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		<-release
+		return fakeResponse{stdout: "\r\n" + req.params["ORDER"]}
+	})
+	return app, release
+}
+
+func waitForQueue(s *FCGIRequester, n int) {
+	for i := 0; i < 200 && s.Stats().Queued != n; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	app, release := blockingApp(t)
+	defer app.Close()
+	s := NewFCGI(app.Addr())
+	s.MaxQueue = 1
+	s.QueueTimeout = 100 * time.Millisecond
+	s.RetryAfter = 3 * time.Second
+
+	request := func() error {
+		var stdout, stderr bytes.Buffer
+		return s.Request(nil, strings.NewReader(""), &stdout, &stderr)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- request()
+		}()
+		if i == 0 {
+			for s.Stats().Active == 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}
+	waitForQueue(s, 1)
+
+	// The queue is full.
+	var full *QueueFullError
+	if err := request(); !errors.As(err, &full) || !IsOverloaded(err) {
+		t.Errorf("Request to a full queue returned %v", err)
+	}
+	// The queued request times out, and the first is still going.
+	var timeout *QueueTimeoutError
+	if err := <-errs; !errors.As(err, &timeout) {
+		t.Errorf("Queued request returned %v", err)
+	}
+
+	// ServeHTTP turns that into a 503.
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 503 || w.Header().Get("Retry-After") != "3" {
+		t.Errorf("ServeHTTP sent %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	wg.Wait()
+	if err := <-errs; err != nil {
+		t.Errorf("First request returned %v", err)
+	}
+	if stats := s.Stats(); stats.Rejected != 3 || stats.QueueWaits != 0 {
+		t.Errorf("Stats were %+v", stats)
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	app, release := blockingApp(t)
+	defer app.Close()
+	s := NewFCGI(app.Addr())
+
+	var lock sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	start := func(name string, p int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var stdout, stderr bytes.Buffer
+			ctx := WithPriority(context.Background(), p)
+			if err := s.RequestContext(ctx, []string{"ORDER=" + name}, strings.NewReader(""), &stdout, &stderr); err != nil {
+				t.Error(err)
+			}
+			lock.Lock()
+			order = append(order, strings.TrimSpace(stdout.String()))
+			lock.Unlock()
+		}()
+	}
+	start("first", 0)
+	for s.Stats().Active == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	start("low", 0)
+	waitForQueue(s, 1)
+	start("high", 10)
+	waitForQueue(s, 2)
+	close(release)
+	wg.Wait()
+
+	if strings.Join(order, ",") != "first,high,low" {
+		t.Errorf("Requests ran in order %v", order)
+	}
+	if stats := s.Stats(); stats.QueueWaits != 2 || stats.QueueWaitTime == 0 {
+		t.Errorf("Stats were %+v", stats)
+	}
+}
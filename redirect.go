@@ -0,0 +1,69 @@
+package gofcgisrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MaxLocalRedirects is how many local redirects a request may go through.
+const MaxLocalRedirects = 10
+
+// ErrRedirectLoop is returned when a request goes through too many local redirects.
+var ErrRedirectLoop = errors.New("Too many local redirects")
+
+type redirectKey struct{}
+
+type redirectState struct {
+	count int
+	env   []string
+}
+
+// RedirectEnv returns the REDIRECT_* variables for a request re-dispatched by a local
+// redirect, as name=value pairs. HTTPEnv adds them to the environment automatically.
+func RedirectEnv(r *http.Request) []string {
+	if state, ok := r.Context().Value(redirectKey{}).(*redirectState); ok {
+		return state.env
+	}
+	return nil
+}
+
+// isLocalPath reports whether a Location is a local redirect, that is, a path on this server.
+func isLocalPath(location string) bool {
+	return strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//")
+}
+
+// localRedirect re-dispatches r to location through h, as a GET with no body.
+// The REDIRECT_* variables describe the original request.
+func localRedirect(h http.Handler, location string, w http.ResponseWriter, r *http.Request) error {
+	count := 0
+	if state, ok := r.Context().Value(redirectKey{}).(*redirectState); ok {
+		count = state.count
+	}
+	if count >= MaxLocalRedirects {
+		return ErrRedirectLoop
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return &MalformedResponseError{Err: err}
+	}
+
+	env := []string{"REDIRECT_STATUS=200", "REDIRECT_URL=" + r.URL.Path}
+	if r.URL.RawQuery != "" {
+		env = append(env, "REDIRECT_QUERY_STRING="+r.URL.RawQuery)
+	}
+	ctx := context.WithValue(r.Context(), redirectKey{}, &redirectState{count: count + 1, env: env})
+	r2 := r.Clone(ctx)
+	r2.Method = "GET"
+	r2.Body = http.NoBody
+	r2.ContentLength = 0
+	r2.TransferEncoding = nil
+	r2.Header.Del("Content-Length")
+	r2.Header.Del("Content-Type")
+	r2.URL = &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	r2.RequestURI = r2.URL.RequestURI()
+	h.ServeHTTP(w, r2)
+	return nil
+}
@@ -0,0 +1,85 @@
+package gofcgisrv
+
+import (
+	"bufio"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedirects(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		switch req.params["REQUEST_URI"] {
+		case "/old?a=b":
+			return fakeResponse{stdout: "Location: /new?c=d\r\n\r\n"}
+		case "/new?c=d":
+			return fakeResponse{stdout: "Content-Type: text/plain\r\n\r\n" +
+				req.params["REQUEST_METHOD"] + " " + req.params["REDIRECT_URL"] + " " +
+				req.params["REDIRECT_QUERY_STRING"] + " " + req.params["REDIRECT_STATUS"]}
+		case "/away":
+			return fakeResponse{stdout: "Location: http://example.com/\r\n\r\n"}
+		case "/loop":
+			return fakeResponse{stdout: "Location: /loop\r\n\r\n"}
+		case "/moved":
+			return fakeResponse{stdout: "Status: 301 Gone Fishing\r\nLocation: /new\r\n\r\n"}
+		}
+		return fakeResponse{stdout: "Status: 404\r\n\r\n"}
+	})
+	defer app.Close()
+	s := NewFCGI(app.Addr())
+
+	data := []struct {
+		method, path string
+		code         int
+		location     string
+		body         string
+	}{
+		{"POST", "/old?a=b", 200, "", "GET /old a=b 200"},
+		{"GET", "/away", 302, "http://example.com/", ""},
+		{"GET", "/moved", 301, "/new", ""},
+		{"GET", "/loop", 500, "", "Internal Server Error\n"},
+	}
+	for _, d := range data {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(d.method, d.path, strings.NewReader("body")))
+		if w.Code != d.code || w.Header().Get("Location") != d.location || w.Body.String() != d.body {
+			t.Errorf("%s: got %d, Location %q, body %q", d.path, w.Code, w.Header().Get("Location"), w.Body.String())
+		}
+	}
+}
+
+func TestReadCGIHeader(t *testing.T) {
+	data := []struct {
+		header string
+		code   int
+		status string
+	}{
+		{"Content-Type: text/plain\r\n\r\n", 200, "200 OK"},
+		{"Status: 404 Not Here\n\n", 404, "404 Not Here"},
+		{"Status: 503\r\n\r\n", 503, "503 Service Unavailable"},
+		{"Location: http://example.com/\r\n\r\n", 302, "302 Found"},
+		{"Status: 200 OK\r\nLocation: http://example.com/\r\n\r\n", 200, "200 OK"},
+		// Malformed.
+		{"Status: 4040\r\n\r\n", 0, ""},
+		{"Status: OK\r\n\r\n", 0, ""},
+		{"Status: 200\r\nStatus: 404\r\n\r\n", 0, ""},
+		{"Location: /a\r\nLocation: /b\r\n\r\n", 0, ""},
+		{"Content-Type text/plain\r\n\r\n", 0, ""},
+		{"Content-Type: text/plain\r\n", 0, ""},
+	}
+	for _, d := range data {
+		h, err := readCGIHeader(bufio.NewReader(strings.NewReader(d.header)))
+		var malformed *MalformedResponseError
+		switch {
+		case d.code == 0:
+			if !errors.As(err, &malformed) {
+				t.Errorf("%q: expected malformed response, got %v", d.header, err)
+			}
+		case err != nil:
+			t.Errorf("%q: %v", d.header, err)
+		case h.code != d.code || h.status != d.status:
+			t.Errorf("%q: got %d %q", d.header, h.code, h.status)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package gofcgisrv
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxHeaderBytes is the largest CGI header block accepted.
+const DefaultMaxHeaderBytes = 1 << 20
+
+// ErrHeaderTooLarge means an application's header block was too long.
+// It comes wrapped in a MalformedResponseError.
+var ErrHeaderTooLarge = errors.New("Response header too large")
+
+// headerLimitReader limits how much can be read until the header block is done.
+// A negative remaining means no limit.
+type headerLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *headerLimitReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return l.r.Read(p)
+	}
+	if l.remaining == 0 {
+		return 0, ErrHeaderTooLarge
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// readLimitedHeader reads a CGI header block of at most max bytes from r, returning
+// it and a reader for the rest.
+func readLimitedHeader(r io.Reader, max int64) (*cgiHeader, *bufio.Reader, error) {
+	if max <= 0 {
+		max = DefaultMaxHeaderBytes
+	}
+	limit := &headerLimitReader{r: r, remaining: max}
+	br := bufio.NewReader(limit)
+	h, err := readCGIHeader(br)
+	limit.remaining = -1
+	return h, br, err
+}
+
+// ReadResponse parses a CGI response, as written by an application to stdout.
+// The header may use bare LF line endings, and may be at most DefaultMaxHeaderBytes long.
+// The response body streams from r.
+//
+// A Location header with no Status is a redirect, so the response is a 302. If the
+// Location is a local path and there is no body, it is a local redirect, which the server
+// should serve in place of the original request; IsLocalRedirect reports those.
+//
+// An application that sends Transfer-Encoding: chunked gets its body decoded, and
+// any trailers after it are put in the response's Trailer once the body is read.
+func ReadResponse(r io.Reader) (*http.Response, error) {
+	return readResponse(r, DefaultMaxHeaderBytes)
+}
+
+// localRedirectBody is the empty body of a local redirect, marking it as one.
+type localRedirectBody struct{}
+
+func (localRedirectBody) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (localRedirectBody) Close() error {
+	return nil
+}
+
+// IsLocalRedirect reports whether resp, from ReadResponse or a Transport, is a CGI
+// local redirect.
+func IsLocalRedirect(resp *http.Response) bool {
+	body := resp.Body
+	if tb, ok := body.(*transportBody); ok {
+		body = tb.ReadCloser
+	}
+	_, ok := body.(localRedirectBody)
+	return ok
+}
+
+// readResponse is ReadResponse with a header size limit.
+func readResponse(r io.Reader, maxHeader int64) (*http.Response, error) {
+	h, br, err := readLimitedHeader(r, maxHeader)
+	if err != nil {
+		return nil, err
+	}
+	resp := &http.Response{
+		Status:        h.status,
+		StatusCode:    h.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(h.header),
+		ContentLength: -1,
+	}
+
+	if location := resp.Header.Get("Location"); !h.hasStatus && isLocalPath(location) {
+		if _, err := br.Peek(1); err == io.EOF {
+			resp.ContentLength = 0
+			resp.Body = localRedirectBody{}
+			return resp, nil
+		}
+	}
+
+	var body io.Reader = br
+	if strings.EqualFold(strings.TrimSpace(resp.Header.Get("Transfer-Encoding")), "chunked") {
+		resp.Header.Del("Transfer-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.TransferEncoding = []string{"chunked"}
+		resp.Trailer = make(http.Header)
+		for _, vals := range resp.Header["Trailer"] {
+			for _, key := range strings.Split(vals, ",") {
+				if key = strings.TrimSpace(key); key != "" {
+					resp.Trailer[http.CanonicalHeaderKey(key)] = nil
+				}
+			}
+		}
+		resp.Header.Del("Trailer")
+		body = &chunkedBody{br: br, chunks: httputil.NewChunkedReader(br), trailer: resp.Trailer}
+	} else if cl := resp.Header.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(strings.TrimSpace(cl), 10, 64)
+		if err != nil || n < 0 {
+			return nil, &MalformedResponseError{Err: errors.New("Bad Content-Length " + strconv.Quote(cl))}
+		}
+		resp.ContentLength = n
+		body = io.LimitReader(br, n)
+	}
+	resp.Body = ioutil.NopCloser(body)
+	return resp, nil
+}
+
+// chunkedBody decodes a chunked body and reads the trailers after it.
+type chunkedBody struct {
+	br      *bufio.Reader
+	chunks  io.Reader
+	trailer http.Header
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	n, err := b.chunks.Read(p)
+	if err == io.EOF {
+		tr, terr := textproto.NewReader(b.br).ReadMIMEHeader()
+		// Be forgiving about a missing blank line at the very end.
+		if terr != nil && !(terr == io.EOF && len(tr) == 0) {
+			return n, &MalformedResponseError{Err: terr}
+		}
+		for k, v := range tr {
+			b.trailer[k] = v
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,91 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReadResponse(t *testing.T) {
+	data := []struct {
+		output   string
+		code     int
+		location string
+		local    bool
+		body     string
+	}{
+		{"Content-Type: text/plain\r\n\r\nhello", 200, "", false, "hello"},
+		// Bare LFs
+		{"Status: 404 Not Here\nContent-Type: text/plain\n\nmissing", 404, "", false, "missing"},
+		{"Location: http://example.com/\r\n\r\n", 302, "http://example.com/", false, ""},
+		{"Location: /elsewhere?a=b\r\n\r\n", 302, "/elsewhere?a=b", true, ""},
+		// Not local: there is a body, or a Status.
+		{"Location: /elsewhere\r\n\r\nGo there", 302, "/elsewhere", false, "Go there"},
+		{"Status: 301\r\nLocation: /elsewhere\r\n\r\n", 301, "/elsewhere", false, ""},
+		{"Content-Length: 3\r\n\r\nabcdef", 200, "", false, "abc"},
+	}
+	for _, d := range data {
+		resp, err := ReadResponse(strings.NewReader(d.output))
+		if err != nil {
+			t.Errorf("%q: %v", d.output, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != d.code || resp.Header.Get("Location") != d.location ||
+			IsLocalRedirect(resp) != d.local || string(body) != d.body {
+			t.Errorf("%q: got %s, Location %q, local %v, body %q", d.output, resp.Status,
+				resp.Header.Get("Location"), IsLocalRedirect(resp), body)
+		}
+	}
+
+	// headerRequester's output, for one.
+	var out bytes.Buffer
+	if err := headerRequester([]string{"FOO=BAR"}, nil, &out, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ReadResponse(&out)
+	if err != nil || resp.StatusCode != 200 || resp.ContentLength != int64(len(`{"FOO":"BAR"}`)) {
+		t.Errorf("headerRequester's output gave %v, %v", resp, err)
+	}
+}
+
+func TestReadResponseLimits(t *testing.T) {
+	huge := "X-Big: " + strings.Repeat("x", DefaultMaxHeaderBytes) + "\r\n\r\n"
+	_, err := ReadResponse(strings.NewReader(huge))
+	var malformed *MalformedResponseError
+	if !errors.As(err, &malformed) || !errors.Is(err, ErrHeaderTooLarge) {
+		t.Errorf("Huge header returned %v", err)
+	}
+
+	// A big body is fine.
+	resp, err := ReadResponse(strings.NewReader("\r\n" + strings.Repeat("x", 2*DefaultMaxHeaderBytes)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := io.Copy(ioutil.Discard, resp.Body); n != 2*DefaultMaxHeaderBytes {
+		t.Errorf("Read %d bytes of body", n)
+	}
+}
+
+func TestReadResponseStreaming(t *testing.T) {
+	pr, pw := io.Pipe()
+	go io.WriteString(pw, "Content-Type: text/plain\r\n\r\nfirst")
+	resp, err := ReadResponse(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "first" {
+		t.Errorf("Read %q, %v", buf, err)
+	}
+	go func() {
+		io.WriteString(pw, " second")
+		pw.Close()
+	}()
+	if rest, _ := ioutil.ReadAll(resp.Body); string(rest) != " second" {
+		t.Errorf("Read %q", rest)
+	}
+}
@@ -2,6 +2,8 @@ package gofcgisrv
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -9,15 +11,41 @@ import (
 )
 
 type SCGIRequester struct {
-	applicationAddr string
+	dialer Dialer
+	active activeSet
+
+	// Timeouts limit each phase of a request.
+	Timeouts Timeouts
 }
 
 func (sr *SCGIRequester) Request(env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	return sr.RequestContext(context.Background(), env, stdin, stdout, stderr)
+}
+
+// RequestContext is like Request, but closes the connection if ctx is done before
+// the application has finished.
+func (sr *SCGIRequester) RequestContext(ctx context.Context, env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	// Timeouts cancel the request, saying why.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer cancelAfter(cancel, sr.Timeouts.Total, &TotalTimeoutError{Limit: sr.Timeouts.Total})()
+	done, err := sr.active.add(cancel)
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	// Make a connection
-	conn, err := net.Dial("tcp", sr.applicationAddr)
+	conn, err := sr.Timeouts.dial(ctx, sr.dialer)
 	if err != nil {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
 		return err
 	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	stopSend := cancelAfter(cancel, sr.Timeouts.Send, &SendTimeoutError{Limit: sr.Timeouts.Send})
 
 	// Send the environment
 	header := bytes.NewBuffer(nil)
@@ -39,13 +67,20 @@ func (sr *SCGIRequester) Request(env []string, stdin io.Reader, stdout io.Writer
 	_, err = fmt.Fprintf(conn, "%d:%s,", header.Len(), header.Bytes())
 	if err != nil {
 		conn.Close()
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
 		return err
 	}
-	_, err = io.Copy(conn, stdin)
+	_, err = io.Copy(conn, ctxReader{ctx, stdin})
 	if err != nil {
 		conn.Close()
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
 		return err
 	}
+	stopSend()
 
 	// Flup needs the write side closed. I don't think that's right, but there it is.
 	if cw, ok := conn.(interface {
@@ -53,7 +88,15 @@ func (sr *SCGIRequester) Request(env []string, stdin io.Reader, stdout io.Writer
 	}); ok {
 		cw.CloseWrite()
 	}
-	_, err = io.Copy(stdout, conn)
+	_, err = io.Copy(stdout, &phaseReader{conn: conn, t: sr.Timeouts})
+	conn.Close()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return err
+	}
 	// If we have an error, just log it to stderr.
 	if err != nil {
 		stderr.Write([]byte(err.Error()))
@@ -61,6 +104,29 @@ func (sr *SCGIRequester) Request(env []string, stdin io.Reader, stdout io.Writer
 	return nil
 }
 
+// Close cancels any requests in progress with ErrClosed, closing their connections,
+// and makes later requests fail the same way. Children of a StdinDialer or
+// ProcessManager are stopped.
+func (sr *SCGIRequester) Close() error {
+	sr.active.close()
+	return closeDialer(sr.dialer)
+}
+
 func NewSCGI(addr string) *SCGIRequester {
-	return &SCGIRequester{applicationAddr: addr}
+	return NewSCGIDialer(TCPDialer{addr: addr})
+}
+
+// NewSCGIDialer creates an SCGI requester that connects to the application with d.
+func NewSCGIDialer(d Dialer) *SCGIRequester {
+	return &SCGIRequester{dialer: d}
+}
+
+// NewSCGIURL creates an SCGI requester that connects to the application at a URL.
+// See ParseDialer.
+func NewSCGIURL(rawurl string) (*SCGIRequester, error) {
+	d, err := ParseDialer(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return NewSCGIDialer(d), nil
 }
@@ -2,13 +2,19 @@ package gofcgisrv
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/fcgi"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func serve(w http.ResponseWriter, r *http.Request) {
@@ -58,3 +64,448 @@ func TestFCGI(t *testing.T) {
 		t.Errorf("Response was %s\n", body)
 	}
 }
+
+// countingDialer counts the connections it makes.
+type countingDialer struct {
+	Dialer
+	n int32
+}
+
+func (d *countingDialer) Dial() (net.Conn, error) {
+	atomic.AddInt32(&d.n, 1)
+	return d.Dialer.Dial()
+}
+
+func TestFCGIMultiplex(t *testing.T) {
+	l, err := startFCGIApp(t, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := NewFCGI(l.Addr().String())
+	dialer := &countingDialer{Dialer: s.dialer}
+	s.dialer = dialer
+	s.CanMultiplex = true
+	s.MaxConns = 1
+	s.MaxRequests = 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			text := strings.Repeat(fmt.Sprintf("request %d\n", i), 1000)
+			env := []string{
+				"REQUEST_METHOD=POST",
+				"SERVER_PROTOCOL=HTTP/1.1",
+				"REQUEST_URI=/",
+				fmt.Sprintf("CONTENT_LENGTH=%d", len(text)),
+			}
+			var stdout, stderr bytes.Buffer
+			if err := s.Request(env, strings.NewReader(text), &stdout, &stderr); err != nil {
+				t.Error(err)
+				return
+			}
+			if !strings.HasSuffix(stdout.String(), "FCGI!\n"+text) {
+				t.Errorf("Request %d got the wrong response", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&dialer.n); n != 1 {
+		t.Errorf("Dialed %d connections, not 1", n)
+	}
+}
+
+// connTrackingListener remembers the connections it accepts so a test can
+// close them out from under the client.
+type connTrackingListener struct {
+	net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func (l *connTrackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.lock.Lock()
+		l.conns = append(l.conns, c)
+		l.lock.Unlock()
+	}
+	return c, err
+}
+
+func (l *connTrackingListener) closeConns() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.conns = nil
+}
+
+func fcgiGet(t *testing.T, s Requester) {
+	env := []string{"REQUEST_METHOD=GET", "SERVER_PROTOCOL=HTTP/1.1", "REQUEST_URI=/", "CONTENT_LENGTH=0"}
+	var stdout, stderr bytes.Buffer
+	if err := s.Request(env, strings.NewReader(""), &stdout, &stderr); err != nil {
+		t.Error(err)
+	}
+	if !strings.HasSuffix(stdout.String(), "FCGI!\n") {
+		t.Errorf("Response was %q", stdout.String())
+	}
+}
+
+// stuckWriter blocks writes until release is closed.
+type stuckWriter struct {
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *stuckWriter) Write(data []byte) (int, error) {
+	<-w.release
+	return w.buf.Write(data)
+}
+
+func TestFCGISlowReader(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		return fakeResponse{stdout: "\r\n" + req.params["REQUEST_URI"]}
+	})
+	defer app.Close()
+	s := NewFCGI(app.Addr())
+	s.CanMultiplex = true
+	s.MaxConns = 1
+	s.MaxRequests = 2
+
+	// One request's output can't be delivered...
+	slow := &stuckWriter{release: make(chan struct{})}
+	slowDone := make(chan error, 1)
+	go func() {
+		slowDone <- s.Request([]string{"REQUEST_URI=/slow"}, strings.NewReader(""), slow, io.Discard)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// ...which mustn't hold up another on the same connection.
+	done := make(chan error, 1)
+	var fast bytes.Buffer
+	go func() {
+		done <- s.Request([]string{"REQUEST_URI=/fast"}, strings.NewReader(""), &fast, io.Discard)
+	}()
+	select {
+	case err := <-done:
+		if err != nil || fast.String() != "\r\n/fast" {
+			t.Errorf("Fast request got %v, %q", err, fast.String())
+		}
+	case <-time.After(time.Second):
+		t.Error("Request was held up by another's client")
+	}
+
+	close(slow.release)
+	if err := <-slowDone; err != nil || slow.buf.String() != "\r\n/slow" {
+		t.Errorf("Slow request got %v, %q", err, slow.buf.String())
+	}
+	if n := s.Stats().Conns; n != 1 {
+		t.Errorf("Used %d connections", n)
+	}
+}
+
+// queuedBytes returns how much output is held for the first request on s's
+// first connection.
+func queuedBytes(s *FCGIRequester) int {
+	s.reqLock.Lock()
+	defer s.reqLock.Unlock()
+	if len(s.connections) == 0 {
+		return 0
+	}
+	r := s.connections[0].findRequest(1)
+	if r == nil {
+		return 0
+	}
+	r.out.lock.Lock()
+	defer r.out.lock.Unlock()
+	return r.out.size
+}
+
+func TestFCGISlowReaderBounded(t *testing.T) {
+	const size = 8 << 20
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		if req.params["REQUEST_URI"] == "/fast" {
+			return fakeResponse{stdout: "\r\nfast"}
+		}
+		return fakeResponse{stdout: strings.Repeat("x", size)}
+	})
+	defer app.Close()
+
+	// On a connection of its own, the application is made to wait.
+	s := NewFCGI(app.Addr())
+	slow := &stuckWriter{release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Request(nil, strings.NewReader(""), slow, io.Discard)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if n := queuedBytes(s); n == 0 || n > maxQueuedOutput {
+		t.Errorf("%d bytes queued for a stalled client", n)
+	}
+	close(slow.release)
+	if err := <-done; err != nil || slow.buf.Len() != size {
+		t.Errorf("Stalled request got %v, %d bytes", err, slow.buf.Len())
+	}
+
+	// On a shared one, the request fails rather than hold up the rest.
+	s = NewFCGI(app.Addr())
+	s.CanMultiplex = true
+	s.MaxRequests = 2
+	slow = &stuckWriter{release: make(chan struct{})}
+	go func() {
+		done <- s.Request(nil, strings.NewReader(""), slow, io.Discard)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	var fast bytes.Buffer
+	if err := s.Request([]string{"REQUEST_URI=/fast"}, strings.NewReader(""), &fast, io.Discard); err != nil || fast.String() != "\r\nfast" {
+		t.Errorf("Request sharing the connection got %v, %q", err, fast.String())
+	}
+	close(slow.release)
+	var slowErr *SlowClientError
+	if err := <-done; !errors.As(err, &slowErr) || slow.buf.Len() >= size {
+		t.Errorf("Stalled request got %v, %d bytes", err, slow.buf.Len())
+	}
+	if n := s.Stats().Conns; n != 1 {
+		t.Errorf("Used %d connections", n)
+	}
+}
+
+func TestFCGIKeepConns(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &connTrackingListener{Listener: inner}
+	defer l.Close()
+	go fcgi.Serve(l, http.HandlerFunc(serve))
+
+	s := NewFCGI(l.Addr().String())
+	dialer := &countingDialer{Dialer: s.dialer}
+	s.dialer = dialer
+	s.KeepConns = true
+	s.IdleTimeout = 50 * time.Millisecond
+
+	for i := 0; i < 5; i++ {
+		fcgiGet(t, s)
+	}
+	if n := atomic.LoadInt32(&dialer.n); n != 1 {
+		t.Errorf("Dialed %d connections, not 1", n)
+	}
+
+	// The application drops the connection; we should notice and redial.
+	l.closeConns()
+	fcgiGet(t, s)
+	if n := atomic.LoadInt32(&dialer.n); n != 2 {
+		t.Errorf("Dialed %d connections, not 2", n)
+	}
+
+	// Let the connection go idle for too long.
+	time.Sleep(100 * time.Millisecond)
+	fcgiGet(t, s)
+	if n := atomic.LoadInt32(&dialer.n); n != 3 {
+		t.Errorf("Dialed %d connections, not 3", n)
+	}
+}
+
+func TestFCGIKeepConnsRetry(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &connTrackingListener{Listener: inner}
+	defer l.Close()
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+
+	s := NewFCGI(l.Addr().String())
+	s.KeepConns = true
+	env := []string{"REQUEST_METHOD=POST", "SERVER_PROTOCOL=HTTP/1.1", "REQUEST_URI=/", "CONTENT_LENGTH=5"}
+	// Each time the application closes the idle connection, the next request
+	// has to go on a new one, with its body sent again.
+	for i := 0; i < 50; i++ {
+		var stdout bytes.Buffer
+		if err := s.Request(env, strings.NewReader("hello"), &stdout, io.Discard); err != nil {
+			t.Fatalf("Request %d: %v", i, err)
+		}
+		if !strings.HasSuffix(stdout.String(), "hello") {
+			t.Fatalf("Request %d got %q", i, stdout.String())
+		}
+		l.closeConns()
+	}
+}
+
+func TestFCGIKeepConnsNoRetry(t *testing.T) {
+	// The application runs every other request and then crashes.
+	var calls int32
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 2 || n == 4 {
+			return fakeResponse{drop: true}
+		}
+		return fakeResponse{stdout: "\r\nok"}
+	})
+	defer app.Close()
+	s := NewFCGI(app.Addr())
+	s.KeepConns = true
+
+	request := func(method string) error {
+		env := []string{"REQUEST_METHOD=" + method, "REQUEST_URI=/"}
+		return s.Request(env, strings.NewReader(""), &bytes.Buffer{}, io.Discard)
+	}
+	// A POST that may have been run isn't run again.
+	if err := request("POST"); err != nil {
+		t.Fatal(err)
+	}
+	var dropped *ConnectionDroppedError
+	if err := request("POST"); !errors.As(err, &dropped) {
+		t.Errorf("POST on a dropped connection got %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Two POSTs ran %d times", n)
+	}
+	// A GET is.
+	if err := request("GET"); err != nil {
+		t.Fatal(err)
+	}
+	if err := request("GET"); err != nil {
+		t.Errorf("GET on a dropped connection got %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 5 {
+		t.Errorf("Two GETs ran %d times", n-2)
+	}
+}
+
+// slowFirstDialer's first dial blocks until its context is done.
+type slowFirstDialer struct {
+	Dialer
+	n int32
+}
+
+func (d *slowFirstDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	if atomic.AddInt32(&d.n, 1) == 1 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return d.Dialer.Dial()
+}
+
+func TestFCGISlowDial(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		return fakeResponse{stdout: "\r\nok"}
+	})
+	defer app.Close()
+	dialer := &slowFirstDialer{Dialer: TCPDialer{addr: app.Addr()}}
+	s := NewFCGIDialer(dialer)
+	s.MaxConns = 2
+	s.MaxRequests = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.RequestContext(ctx, nil, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+	}()
+	for atomic.LoadInt32(&dialer.n) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A stuck dial mustn't hold up other requests.
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Request(nil, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Request was held up by another's dial")
+	}
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Cancelled dial got %v", err)
+	}
+	if n := s.Stats().Active; n != 0 {
+		t.Errorf("%d requests still active", n)
+	}
+}
+
+func TestFCGIAbort(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		<-release
+		return fakeResponse{stdout: "\r\nToo late"}
+	})
+	defer app.Close()
+
+	s := NewFCGI(app.Addr())
+	// Make sure we aren't rescued by the timeout.
+	s.AbortTimeout = time.Minute
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		var stdout, stderr bytes.Buffer
+		start := time.Now()
+		err := s.RequestContext(ctx, nil, strings.NewReader(""), &stdout, &stderr)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("Error was %v", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("Abort took %v", d)
+		}
+		if stdout.Len() != 0 {
+			t.Errorf("Got output %q", stdout.String())
+		}
+	}
+}
+
+func TestFCGIAbortTimeout(t *testing.T) {
+	// net/http/fcgi ignores aborts once it has all of stdin.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	release := make(chan struct{})
+	defer close(release)
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	s := NewFCGI(l.Addr().String())
+	s.AbortTimeout = 50 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	start := time.Now()
+	env := []string{"REQUEST_METHOD=GET", "SERVER_PROTOCOL=HTTP/1.1", "REQUEST_URI=/", "CONTENT_LENGTH=0"}
+	err = s.RequestContext(ctx, env, strings.NewReader(""), &stdout, &stderr)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Error was %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Abort took %v", d)
+	}
+}
+
+func TestCGIContext(t *testing.T) {
+	s := NewCGI("sleep", "10")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	start := time.Now()
+	err := RequestContext(ctx, s, nil, strings.NewReader(""), &stdout, &stderr)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Error was %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Cancel took %v", d)
+	}
+}
@@ -0,0 +1,133 @@
+package gofcgisrv
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned for requests made after a requester is shut down or closed,
+// and for requests cancelled by Close.
+var ErrClosed = errors.New("Requester is closed")
+
+// Shutdown stops the requester taking new requests and waits for those in progress
+// to finish. If ctx is done first, the rest are aborted and ctx's error is returned.
+// Either way all connections are then closed, and so is the dialer if it can be:
+// the children of a StdinDialer or ProcessManager are stopped.
+func (s *FCGIRequester) Shutdown(ctx context.Context) error {
+	s.reqLock.Lock()
+	s.closing = true
+	// Anyone queued gives up.
+	s.reqCond.Broadcast()
+	stop := context.AfterFunc(ctx, func() {
+		s.reqLock.Lock()
+		s.reqCond.Broadcast()
+		s.reqLock.Unlock()
+	})
+	defer stop()
+	for s.numRequests() > 0 && ctx.Err() == nil {
+		s.reqCond.Wait()
+	}
+	err := ctx.Err()
+	if err != nil {
+		// Aborted requests end within AbortTimeout, one way or another.
+		s.cancelAll()
+		for s.numRequests() > 0 {
+			s.reqCond.Wait()
+		}
+	}
+	s.closeConns()
+	s.reqLock.Unlock()
+	if derr := closeDialer(s.dialer); err == nil {
+		err = derr
+	}
+	return err
+}
+
+// Close closes the requester at once. Requests in progress are cancelled with
+// ErrClosed and their connections closed without waiting for the application.
+func (s *FCGIRequester) Close() error {
+	s.reqLock.Lock()
+	s.closing = true
+	s.cancelAll()
+	s.closeConns()
+	s.reqCond.Broadcast()
+	s.reqLock.Unlock()
+	return closeDialer(s.dialer)
+}
+
+// cancelAll cancels every request in progress.
+// Should only be called if reqLock is held.
+func (s *FCGIRequester) cancelAll() {
+	for pd := range s.dialing {
+		pd.cancel(ErrClosed)
+	}
+	for _, c := range s.connections {
+		c.reqLock.RLock()
+		for _, r := range c.requests {
+			if r != nil {
+				r.cancel(ErrClosed)
+			}
+		}
+		c.reqLock.RUnlock()
+	}
+}
+
+// closeConns closes every connection.
+// Should only be called if reqLock is held.
+func (s *FCGIRequester) closeConns() {
+	for len(s.connections) > 0 {
+		s.dropConn(s.connections[0])
+	}
+}
+
+// closeDialer stops a dialer's children, if it has any.
+func closeDialer(d Dialer) error {
+	switch d := d.(type) {
+	case *StdinDialer:
+		d.Close()
+	case *ProcessManager:
+		return d.Close()
+	}
+	return nil
+}
+
+// activeSet tracks the requests in progress on a requester without connections of
+// its own, so that Close can cancel them.
+type activeSet struct {
+	lock    sync.Mutex
+	closed  bool
+	seq     uint64
+	cancels map[uint64]context.CancelCauseFunc
+}
+
+// add registers a request, returning a function to call when it is done, or
+// ErrClosed if the set is closed.
+func (a *activeSet) add(cancel context.CancelCauseFunc) (func(), error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return nil, ErrClosed
+	}
+	if a.cancels == nil {
+		a.cancels = make(map[uint64]context.CancelCauseFunc)
+	}
+	id := a.seq
+	a.seq++
+	a.cancels[id] = cancel
+	return func() {
+		a.lock.Lock()
+		delete(a.cancels, id)
+		a.lock.Unlock()
+	}, nil
+}
+
+// close cancels every request in progress with ErrClosed and refuses any more.
+func (a *activeSet) close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.closed = true
+	for _, cancel := range a.cancels {
+		cancel(ErrClosed)
+	}
+}
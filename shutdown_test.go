@@ -0,0 +1,172 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockedApp starts a fake app whose requests block until release is closed.
+// started gets a value as each request reaches the handler.
+func blockedApp(t *testing.T) (app *fakeApp, started chan bool, release chan struct{}) {
+	started = make(chan bool, 10)
+	release = make(chan struct{})
+	app = startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		started <- true
+		<-release
+		return fakeResponse{stdout: "\r\ndone"}
+	})
+	return app, started, release
+}
+
+func waitClosing(s *FCGIRequester) {
+	for {
+		s.reqLock.Lock()
+		closing := s.closing
+		s.reqLock.Unlock()
+		if closing {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFCGIShutdownDrains(t *testing.T) {
+	app, started, release := blockedApp(t)
+	defer app.Close()
+	s := NewFCGI(app.Addr())
+
+	out := bytes.NewBuffer(nil)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Request(nil, strings.NewReader(""), out, out)
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	waitClosing(s)
+	if err := s.Request(nil, strings.NewReader(""), out, out); err != ErrClosed {
+		t.Errorf("Request after Shutdown got %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a request in progress", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-errc; err != nil || !strings.Contains(out.String(), "done") {
+		t.Errorf("In-progress request got %v, %q", err, out.String())
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	if len(s.connections) != 0 {
+		t.Errorf("%d connections left open", len(s.connections))
+	}
+}
+
+func TestFCGIShutdownAborts(t *testing.T) {
+	app, started, release := blockedApp(t)
+	defer app.Close()
+	defer close(release)
+	s := NewFCGI(app.Addr())
+	s.AbortTimeout = time.Minute
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Request(nil, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Shutdown took %v", d)
+	}
+	if err := <-errc; err != ErrClosed {
+		t.Errorf("Aborted request got %v", err)
+	}
+}
+
+func TestFCGIClose(t *testing.T) {
+	app, started, release := blockedApp(t)
+	defer app.Close()
+	defer close(release)
+	s := NewFCGI(app.Addr())
+	s.MaxRequests = 1
+
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errc <- s.Request(nil, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+		}()
+	}
+	// One runs, the other is queued.
+	<-started
+	s.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			if err != ErrClosed {
+				t.Errorf("Request got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Close did not end requests")
+		}
+	}
+	if code := ErrorStatus(ErrClosed); code != 503 {
+		t.Errorf("ErrClosed is a %d", code)
+	}
+}
+
+func TestSCGIClose(t *testing.T) {
+	l := stallingSCGIApp(t, "")
+	defer l.Close()
+	s := NewSCGI(l.Addr().String())
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Request(nil, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-errc:
+		if err != ErrClosed {
+			t.Errorf("Request got %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Close did not end the request")
+	}
+	if err := s.Request(nil, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{}); err != ErrClosed {
+		t.Errorf("Request after Close got %v", err)
+	}
+}
+
+func TestCGIClose(t *testing.T) {
+	s := NewCGI("sleep", "10")
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Request(nil, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-errc:
+		if err != ErrClosed {
+			t.Errorf("Request got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not kill the child")
+	}
+}
@@ -0,0 +1,87 @@
+package gofcgisrv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// DefaultSpoolMemory is how much of a request body is kept in memory if a
+// SpoolPolicy doesn't say.
+const DefaultSpoolMemory = 1 << 20
+
+// ErrBodyTooLarge is returned for request bodies over a SpoolPolicy's MaxBody.
+// ServeHTTP answers them with 413.
+var ErrBodyTooLarge = errors.New("Request body too large")
+
+// SpoolPolicy says how request bodies of unknown length (chunked uploads, say) are
+// held while CONTENT_LENGTH is worked out.
+type SpoolPolicy struct {
+	// MemoryLimit is how many bytes are kept in memory before the body is moved to
+	// a temporary file. Zero means DefaultSpoolMemory; negative means always use a file.
+	MemoryLimit int64
+	// MaxBody, if nonzero, is the largest body accepted, whether or not its
+	// length is known in advance.
+	MaxBody int64
+	// TempDir is where temporary files go. Empty means os.TempDir().
+	TempDir string
+}
+
+// DefaultSpool is the policy used by the package-level ServeHTTP.
+var DefaultSpool SpoolPolicy
+
+// spool reads all of body, returning a reader for it, its length, and a function to
+// clean up once the reader is no longer needed.
+func (p SpoolPolicy) spool(body io.Reader) (io.Reader, int64, func(), error) {
+	noop := func() {}
+	limit := p.MemoryLimit
+	if limit == 0 {
+		limit = DefaultSpoolMemory
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	if p.MaxBody > 0 && p.MaxBody < limit {
+		limit = p.MaxBody
+	}
+
+	// Read one more than the limit, to see if there is more.
+	buf := bytes.NewBuffer(nil)
+	n, err := io.Copy(buf, io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, 0, noop, err
+	}
+	if n <= limit {
+		return buf, n, noop, nil
+	}
+	if p.MaxBody > 0 && n > p.MaxBody {
+		return nil, 0, noop, ErrBodyTooLarge
+	}
+
+	file, err := ioutil.TempFile(p.TempDir, "gofcgisrv-body")
+	if err != nil {
+		return nil, 0, noop, err
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	rest := body
+	if p.MaxBody > 0 {
+		rest = io.LimitReader(body, p.MaxBody-n+1)
+	}
+	m, err := io.Copy(file, io.MultiReader(buf, rest))
+	if err == nil && p.MaxBody > 0 && m > p.MaxBody {
+		err = ErrBodyTooLarge
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, noop, err
+	}
+	return file, m, cleanup, nil
+}
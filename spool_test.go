@@ -0,0 +1,75 @@
+package gofcgisrv
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	p := SpoolPolicy{MemoryLimit: 4, MaxBody: 10, TempDir: dir}
+	tempFiles := func() int {
+		files, _ := os.ReadDir(dir)
+		return len(files)
+	}
+
+	// Small bodies stay in memory.
+	body, n, cleanup, err := p.spool(strings.NewReader("abc"))
+	if err != nil || n != 3 || tempFiles() != 0 {
+		t.Errorf("Small body: %d bytes, %d files, %v", n, tempFiles(), err)
+	}
+	cleanup()
+
+	// Bigger ones go to disk until they are done with.
+	body, n, cleanup, err = p.spool(strings.NewReader("abcdefgh"))
+	if err != nil || n != 8 || tempFiles() != 1 {
+		t.Errorf("Larger body: %d bytes, %d files, %v", n, tempFiles(), err)
+	}
+	if data, _ := ioutil.ReadAll(body); string(data) != "abcdefgh" {
+		t.Errorf("Spooled body was %q", data)
+	}
+	cleanup()
+	if tempFiles() != 0 {
+		t.Errorf("Temporary file was not removed")
+	}
+
+	// Too big.
+	_, _, cleanup, err = p.spool(strings.NewReader("abcdefghijk"))
+	cleanup()
+	if err != ErrBodyTooLarge || tempFiles() != 0 {
+		t.Errorf("Oversize body: %d files, %v", tempFiles(), err)
+	}
+}
+
+func TestServeHTTPSpool(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		return fakeResponse{stdout: "\r\n" + req.params["CONTENT_LENGTH"] + " " + req.stdin.String()}
+	})
+	defer app.Close()
+	s := NewFCGI(app.Addr())
+	s.Spool = SpoolPolicy{MemoryLimit: -1, MaxBody: 10, TempDir: t.TempDir()}
+
+	// No Content-Length header, so the body has to be spooled.
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+	if w.Code != 200 || w.Body.String() != "5 hello" {
+		t.Errorf("Got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("hello, world")))
+	if w.Code != 413 {
+		t.Errorf("Oversize body got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader("hello, world"))
+	r.Header.Set("Content-Length", "12")
+	s.ServeHTTP(w, r)
+	if w.Code != 413 {
+		t.Errorf("Oversize body with Content-Length got %d", w.Code)
+	}
+}
@@ -67,16 +67,22 @@ func newStreamWriter(w io.Writer, tp recordType, id requestId) *streamWriter {
 func (sw *streamWriter) Write(data []byte) (int, error) {
 	sw.lock.Lock()
 	defer sw.lock.Unlock()
-	if len(data) == 0 {
-		return 0, nil
+	// Records can only hold so much, so big writes (from a WriterTo, say)
+	// have to be split up.
+	n := 0
+	for n < len(data) {
+		chunk := data[n:]
+		if len(chunk) > maxRecordContent {
+			chunk = chunk[:maxRecordContent]
+		}
+		rec := record{sw.tp, sw.id, chunk}
+		// How much did we actually write? Just count whole records.
+		if err := writeRecord(sw.w, rec); err != nil {
+			return n, err
+		}
+		n += len(chunk)
 	}
-	rec := record{sw.tp, sw.id, data}
-	err := writeRecord(sw.w, rec)
-	// How much did we actually write? Just say nothing if we got an error.
-	if err != nil {
-		return 0, err
-	}
-	return len(data), nil
+	return n, nil
 }
 
 func (sw *streamWriter) Close() error {
@@ -0,0 +1,151 @@
+package gofcgisrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Timeouts limit the phases of a request. Zero means no limit.
+// Each phase has its own error type; all of them are net.Errors whose Timeout is true,
+// which ServeHTTP answers with 504. A FastCGI request that times out is aborted
+// as if cancelled, so it may take up to AbortTimeout longer to return, except that
+// a send timeout on a connection that isn't multiplexed just closes it.
+type Timeouts struct {
+	Dial time.Duration // connecting to the application
+	Send time.Duration // sending params and stdin
+	// FirstByte runs from the end of stdin to the first output.
+	FirstByte time.Duration
+	// Idle is the longest wait between pieces of output, once output has started.
+	Idle  time.Duration
+	Total time.Duration // the whole request, including any wait for a connection
+}
+
+// DialTimeoutError means the application couldn't be connected to in time.
+// It comes wrapped in a DialError.
+type DialTimeoutError struct {
+	Limit time.Duration
+}
+
+func (e *DialTimeoutError) Error() string {
+	return fmt.Sprintf("Connecting to application timed out after %v", e.Limit)
+}
+
+func (e *DialTimeoutError) Timeout() bool   { return true }
+func (e *DialTimeoutError) Temporary() bool { return true }
+
+// SendTimeoutError means the request's params and stdin couldn't be sent in time.
+type SendTimeoutError struct {
+	Limit time.Duration
+}
+
+func (e *SendTimeoutError) Error() string {
+	return fmt.Sprintf("Sending request timed out after %v", e.Limit)
+}
+
+func (e *SendTimeoutError) Timeout() bool   { return true }
+func (e *SendTimeoutError) Temporary() bool { return true }
+
+// FirstByteTimeoutError means the application took too long to start its response.
+type FirstByteTimeoutError struct {
+	Limit time.Duration
+}
+
+func (e *FirstByteTimeoutError) Error() string {
+	return fmt.Sprintf("Application sent no output for %v", e.Limit)
+}
+
+func (e *FirstByteTimeoutError) Timeout() bool   { return true }
+func (e *FirstByteTimeoutError) Temporary() bool { return true }
+
+// IdleTimeoutError means the application stalled in the middle of its response.
+type IdleTimeoutError struct {
+	Limit time.Duration
+}
+
+func (e *IdleTimeoutError) Error() string {
+	return fmt.Sprintf("Application output stalled for %v", e.Limit)
+}
+
+func (e *IdleTimeoutError) Timeout() bool   { return true }
+func (e *IdleTimeoutError) Temporary() bool { return true }
+
+// TotalTimeoutError means the whole request took too long.
+type TotalTimeoutError struct {
+	Limit time.Duration
+}
+
+func (e *TotalTimeoutError) Error() string {
+	return fmt.Sprintf("Request timed out after %v", e.Limit)
+}
+
+func (e *TotalTimeoutError) Timeout() bool   { return true }
+func (e *TotalTimeoutError) Temporary() bool { return true }
+
+// cancelAfter cancels with err after d, unless the returned function is called first.
+func cancelAfter(cancel context.CancelCauseFunc, d time.Duration, err error) (stop func() bool) {
+	if d <= 0 {
+		return func() bool { return true }
+	}
+	return time.AfterFunc(d, func() { cancel(err) }).Stop
+}
+
+// dial dials with d, giving up after the dial timeout.
+func (t Timeouts) dial(ctx context.Context, d Dialer) (net.Conn, error) {
+	if t.Dial <= 0 {
+		return dialContext(ctx, d)
+	}
+	dctx, cancel := context.WithTimeoutCause(ctx, t.Dial, &DialTimeoutError{Limit: t.Dial})
+	defer cancel()
+	conn, err := dialContext(dctx, d)
+	var timeout *DialTimeoutError
+	if err != nil && ctx.Err() == nil && errors.As(context.Cause(dctx), &timeout) {
+		return nil, &DialError{Err: timeout}
+	}
+	return conn, err
+}
+
+// ctxReader stops reading once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if cr.ctx.Err() != nil {
+		return 0, context.Cause(cr.ctx)
+	}
+	return cr.r.Read(p)
+}
+
+// phaseReader reads a response from a connection, applying the first byte
+// and idle timeouts as read deadlines.
+type phaseReader struct {
+	conn    net.Conn
+	t       Timeouts
+	started bool
+}
+
+func (pr *phaseReader) Read(p []byte) (int, error) {
+	limit, timeoutErr := pr.t.FirstByte, error(&FirstByteTimeoutError{Limit: pr.t.FirstByte})
+	if pr.started {
+		limit, timeoutErr = pr.t.Idle, &IdleTimeoutError{Limit: pr.t.Idle}
+	}
+	if limit > 0 {
+		pr.conn.SetReadDeadline(time.Now().Add(limit))
+	} else if pr.t.FirstByte > 0 {
+		pr.conn.SetReadDeadline(time.Time{})
+	}
+	n, err := pr.conn.Read(p)
+	if n > 0 {
+		pr.started = true
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = timeoutErr
+	}
+	return n, err
+}
@@ -0,0 +1,173 @@
+package gofcgisrv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stallingFCGIApp reads a request, sends output, and then goes quiet.
+// If read is false it doesn't read anything at all.
+func stallingFCGIApp(t *testing.T, read bool, output string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				if !read {
+					time.Sleep(time.Second)
+					return
+				}
+				for {
+					rec, err := readRecord(c)
+					if err != nil {
+						return
+					}
+					if rec.Type == fcgiStdin && len(rec.Content) == 0 {
+						if output != "" {
+							writeRecord(c, record{fcgiStdout, rec.Id, []byte(output)})
+						}
+						time.Sleep(time.Second)
+						return
+					}
+				}
+			}(c)
+		}
+	}()
+	return l
+}
+
+// blockingDialer never connects.
+type blockingDialer struct{}
+
+func (blockingDialer) Dial() (net.Conn, error) {
+	return nil, errors.New("Dial without a context")
+}
+
+func (blockingDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestFCGITimeouts(t *testing.T) {
+	quiet := stallingFCGIApp(t, true, "")
+	defer quiet.Close()
+	chatty := stallingFCGIApp(t, true, "Content-Type: text/plain\r\n\r\nsome")
+	defer chatty.Close()
+	deaf := stallingFCGIApp(t, false, "")
+	defer deaf.Close()
+
+	limit := 50 * time.Millisecond
+	var dialTimeout *DialTimeoutError
+	var sendTimeout *SendTimeoutError
+	var firstByte *FirstByteTimeoutError
+	var idle *IdleTimeoutError
+	var total *TotalTimeoutError
+	data := []struct {
+		s      *FCGIRequester
+		stdin  string
+		target interface{}
+	}{
+		{NewFCGIDialer(blockingDialer{}), "", &dialTimeout},
+		{NewFCGI(deaf.Addr().String()), strings.Repeat("x", 16<<20), &sendTimeout},
+		{NewFCGI(quiet.Addr().String()), "", &firstByte},
+		{NewFCGI(chatty.Addr().String()), "", &idle},
+		{NewFCGI(quiet.Addr().String()), "", &total},
+	}
+	data[0].s.Timeouts.Dial = limit
+	data[1].s.Timeouts.Send = limit
+	data[2].s.Timeouts.FirstByte = limit
+	data[3].s.Timeouts = Timeouts{FirstByte: time.Second, Idle: limit}
+	data[4].s.Timeouts = Timeouts{FirstByte: time.Second, Total: limit}
+
+	for i, d := range data {
+		// None of these apps answer FCGI_ABORT_REQUEST. A send timeout shouldn't
+		// have to wait for that.
+		if d.target != &sendTimeout {
+			d.s.AbortTimeout = limit
+		}
+		start := time.Now()
+		var stdout bytes.Buffer
+		err := d.s.Request(nil, strings.NewReader(d.stdin), &stdout, io.Discard)
+		if !errors.As(err, d.target) || ErrorStatus(err) != 504 {
+			t.Errorf("%d: returned %v", i, err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%d: took %v", i, elapsed)
+		}
+	}
+}
+
+// stallingSCGIApp reads a request header, sends output, and then goes quiet.
+func stallingSCGIApp(t *testing.T, output string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				r.ReadString(',')
+				io.WriteString(c, output)
+				time.Sleep(time.Second)
+			}(c)
+		}
+	}()
+	return l
+}
+
+func TestSCGITimeouts(t *testing.T) {
+	quiet := stallingSCGIApp(t, "")
+	defer quiet.Close()
+	chatty := stallingSCGIApp(t, "Status: 200 OK\r\n\r\nsome")
+	defer chatty.Close()
+
+	limit := 50 * time.Millisecond
+	s := NewSCGI(quiet.Addr().String())
+	s.Timeouts.FirstByte = limit
+	var firstByte *FirstByteTimeoutError
+	if err := s.Request([]string{"CONTENT_LENGTH=0"}, strings.NewReader(""), io.Discard, io.Discard); !errors.As(err, &firstByte) {
+		t.Errorf("Quiet app returned %v", err)
+	}
+
+	s = NewSCGI(chatty.Addr().String())
+	s.Timeouts = Timeouts{FirstByte: time.Second, Idle: limit}
+	var idle *IdleTimeoutError
+	var stdout bytes.Buffer
+	if err := s.Request([]string{"CONTENT_LENGTH=0"}, strings.NewReader(""), &stdout, io.Discard); !errors.As(err, &idle) || !strings.HasSuffix(stdout.String(), "some") {
+		t.Errorf("Stalled app returned %v after %q", err, stdout.String())
+	}
+
+	s = NewSCGI(quiet.Addr().String())
+	s.Timeouts.Total = limit
+	var total *TotalTimeoutError
+	if err := s.Request([]string{"CONTENT_LENGTH=0"}, strings.NewReader(""), io.Discard, io.Discard); !errors.As(err, &total) {
+		t.Errorf("Slow app returned %v", err)
+	}
+
+	s = NewSCGIDialer(blockingDialer{})
+	s.Timeouts.Dial = limit
+	var dialTimeout *DialTimeoutError
+	if err := s.Request(nil, strings.NewReader(""), io.Discard, io.Discard); !errors.As(err, &dialTimeout) {
+		t.Errorf("Blocked dial returned %v", err)
+	}
+}
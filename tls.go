@@ -0,0 +1,90 @@
+package gofcgisrv
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+)
+
+// TLSVars selects which groups of TLS variables an EnvBuilder adds.
+// HTTPS=on is always set for TLS requests.
+type TLSVars int
+
+const (
+	// TLSScheme adds REQUEST_SCHEME, http or https.
+	TLSScheme TLSVars = 1 << iota
+	// TLSSession adds SSL_PROTOCOL, SSL_CIPHER and SSL_SERVER_NAME.
+	TLSSession
+	// TLSClient adds SSL_CLIENT_VERIFY and, if there is a client certificate,
+	// SSL_CLIENT_S_DN and SSL_CLIENT_I_DN.
+	TLSClient
+	// TLSClientCert adds SSL_CLIENT_CERT, the client certificate as PEM.
+	TLSClientCert
+
+	// TLSAll adds everything.
+	TLSAll = TLSScheme | TLSSession | TLSClient | TLSClientCert
+)
+
+// sslProtocol names TLS versions the way mod_ssl does.
+func sslProtocol(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return tls.VersionName(version)
+}
+
+// tlsEnv returns the selected TLS variables for r, as name=value pairs.
+// https is whether the client used https, which a proxy may have told us.
+func tlsEnv(vars TLSVars, r *http.Request, https bool) []string {
+	var env []string
+	if vars&TLSScheme != 0 {
+		if https {
+			env = append(env, "REQUEST_SCHEME=https")
+		} else {
+			env = append(env, "REQUEST_SCHEME=http")
+		}
+	}
+	state := r.TLS
+	if state == nil {
+		return env
+	}
+	if vars&TLSSession != 0 {
+		env = append(env,
+			"SSL_PROTOCOL="+sslProtocol(state.Version),
+			"SSL_CIPHER="+tls.CipherSuiteName(state.CipherSuite),
+		)
+		if state.ServerName != "" {
+			env = append(env, "SSL_SERVER_NAME="+state.ServerName)
+		}
+	}
+	if vars&TLSClient != 0 {
+		switch {
+		case len(state.PeerCertificates) == 0:
+			env = append(env, "SSL_CLIENT_VERIFY=NONE")
+		case len(state.VerifiedChains) > 0:
+			env = append(env, "SSL_CLIENT_VERIFY=SUCCESS")
+		default:
+			// Presented, but nobody checked it; mod_ssl's optional_no_ca.
+			env = append(env, "SSL_CLIENT_VERIFY=GENEROUS")
+		}
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			env = append(env,
+				"SSL_CLIENT_S_DN="+cert.Subject.String(),
+				"SSL_CLIENT_I_DN="+cert.Issuer.String(),
+			)
+		}
+	}
+	if vars&TLSClientCert != 0 && len(state.PeerCertificates) > 0 {
+		block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: state.PeerCertificates[0].Raw})
+		env = append(env, "SSL_CLIENT_CERT="+string(block))
+	}
+	return env
+}
@@ -0,0 +1,88 @@
+package gofcgisrv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "admin", Organization: []string{"Example"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTLSEnv(t *testing.T) {
+	cert := testCert(t)
+	r := httptest.NewRequest("GET", "https://example.com/", nil)
+	r.TLS.Version = tls.VersionTLS13
+	r.TLS.CipherSuite = tls.TLS_AES_128_GCM_SHA256
+	r.TLS.ServerName = "example.com"
+	r.TLS.PeerCertificates = []*x509.Certificate{cert}
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+
+	// Nothing extra unless asked.
+	env := envToMap(HTTPEnv(nil, r))
+	if env["HTTPS"] != "on" || env["REQUEST_SCHEME"] != "" || env["SSL_CLIENT_S_DN"] != "" {
+		t.Errorf("Default environment was %v", env)
+	}
+
+	env = envToMap((&EnvBuilder{TLS: TLSAll}).Env(nil, r))
+	want := map[string]string{
+		"REQUEST_SCHEME":    "https",
+		"SSL_PROTOCOL":      "TLSv1.3",
+		"SSL_CIPHER":        "TLS_AES_128_GCM_SHA256",
+		"SSL_SERVER_NAME":   "example.com",
+		"SSL_CLIENT_VERIFY": "SUCCESS",
+		"SSL_CLIENT_S_DN":   "CN=admin,O=Example",
+	}
+	for k, v := range want {
+		if env[k] != v {
+			t.Errorf("%s was %q, not %q", k, env[k], v)
+		}
+	}
+	block, _ := pem.Decode([]byte(env["SSL_CLIENT_CERT"]))
+	if block == nil || string(block.Bytes) != string(cert.Raw) {
+		t.Errorf("SSL_CLIENT_CERT was %q", env["SSL_CLIENT_CERT"])
+	}
+
+	// An unchecked certificate, and none at all.
+	r.TLS.VerifiedChains = nil
+	if env = envToMap((&EnvBuilder{TLS: TLSClient}).Env(nil, r)); env["SSL_CLIENT_VERIFY"] != "GENEROUS" {
+		t.Errorf("Unverified SSL_CLIENT_VERIFY was %q", env["SSL_CLIENT_VERIFY"])
+	}
+	r.TLS.PeerCertificates = nil
+	if env = envToMap((&EnvBuilder{TLS: TLSClient}).Env(nil, r)); env["SSL_CLIENT_VERIFY"] != "NONE" {
+		t.Errorf("Missing SSL_CLIENT_VERIFY was %q", env["SSL_CLIENT_VERIFY"])
+	}
+
+	// Plain http gets only the scheme.
+	env = envToMap((&EnvBuilder{TLS: TLSAll}).Env(nil, httptest.NewRequest("GET", "/", nil)))
+	if env["REQUEST_SCHEME"] != "http" || env["HTTPS"] != "" || env["SSL_CLIENT_VERIFY"] != "" {
+		t.Errorf("Plain environment was %v", env)
+	}
+}
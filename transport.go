@@ -0,0 +1,120 @@
+package gofcgisrv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Transport is an http.RoundTripper that sends requests to a Requester, so that
+// FastCGI, SCGI or CGI applications can be used with http.Client or httputil.ReverseProxy.
+// Responses stream from the application as it produces them.
+type Transport struct {
+	Requester Requester
+
+	// Env builds the environment. If nil, HTTPEnv is used.
+	Env *EnvBuilder
+
+	// Spool says how request bodies of unknown length are held.
+	Spool SpoolPolicy
+
+	// MaxHeaderBytes limits the size of the application's header block.
+	// Zero means DefaultMaxHeaderBytes.
+	MaxHeaderBytes int64
+
+	// Stderr gets the application's error output. If nil, os.Stderr does.
+	Stderr io.Writer
+}
+
+// NewTransport returns a Transport for s.
+func NewTransport(s Requester) *Transport {
+	return &Transport{Requester: s}
+}
+
+// env returns the environment and stdin for req, and a function to call
+// when the body is done with.
+func (t *Transport) env(req *http.Request) ([]string, io.Reader, func(), error) {
+	// Client requests don't have all the fields a server's do.
+	r := new(http.Request)
+	*r = *req
+	if r.Host == "" {
+		r.Host = req.URL.Host
+	}
+	var env []string
+	if t.Env != nil {
+		env = t.Env.Env(nil, r)
+	} else {
+		env = HTTPEnv(nil, r)
+	}
+
+	cleanup := func() {}
+	switch {
+	case req.Body == nil || req.Body == http.NoBody:
+		return append(env, "CONTENT_LENGTH=0"), strings.NewReader(""), cleanup, nil
+	case req.ContentLength > 0:
+		if t.Spool.MaxBody > 0 && req.ContentLength > t.Spool.MaxBody {
+			req.Body.Close()
+			return nil, nil, cleanup, ErrBodyTooLarge
+		}
+		return append(env, fmt.Sprintf("CONTENT_LENGTH=%d", req.ContentLength)), req.Body, func() { req.Body.Close() }, nil
+	}
+	body, n, cleanup, err := t.Spool.spool(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, nil, cleanup, err
+	}
+	return append(env, fmt.Sprintf("CONTENT_LENGTH=%d", n)), body, cleanup, nil
+}
+
+// RoundTrip runs req. An error is returned if the application fails before
+// sending a header; after that, errors come from reading the body.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	env, body, cleanup, err := t.env(req)
+	if err != nil {
+		return nil, err
+	}
+	stderr := t.Stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	outreader, outwriter := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		defer cleanup()
+		err := RequestContext(ctx, t.Requester, env, body, outwriter, stderr)
+		outwriter.CloseWithError(err)
+		errc <- err
+	}()
+
+	resp, err := readResponse(outreader, t.MaxHeaderBytes)
+	if err != nil {
+		cancel()
+		outreader.Close()
+		// The request's own error says more than a broken header does.
+		if rerr := <-errc; rerr != nil {
+			err = rerr
+		}
+		return nil, err
+	}
+	resp.Request = req
+	resp.Body = &transportBody{ReadCloser: resp.Body, pipe: outreader, cancel: cancel}
+	return resp, nil
+}
+
+// transportBody stops the request when the body is closed.
+type transportBody struct {
+	io.ReadCloser
+	pipe   *io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (b *transportBody) Close() error {
+	b.pipe.Close()
+	b.cancel()
+	return nil
+}
@@ -0,0 +1,101 @@
+package gofcgisrv
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func TestTransport(t *testing.T) {
+	app := startFakeApp(t, func(req *fakeRequest) fakeResponse {
+		switch req.params["REQUEST_URI"] {
+		case "/echo":
+			return fakeResponse{stdout: "Status: 201 Made It\r\nX-Length: " + req.params["CONTENT_LENGTH"] + "\r\n\r\n" + req.stdin.String()}
+		case "/trailers":
+			return fakeResponse{stdout: "Transfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n" +
+				"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 42\r\n\r\n"}
+		}
+		return fakeResponse{stdout: "Content-Type: text/plain\r\n\r\n" + req.params["SERVER_NAME"] + " " + req.params["QUERY_STRING"]}
+	})
+	defer app.Close()
+	client := &http.Client{Transport: NewTransport(NewFCGI(app.Addr()))}
+
+	resp, err := client.Get("http://example.com/?a=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "example.com a=b" || resp.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("GET got %s %v %q", resp.Status, resp.Header, body)
+	}
+
+	// A body of unknown length.
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, "some data")
+		pw.Close()
+	}()
+	resp, err = client.Post("http://example.com/echo", "text/plain", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Status != "201 Made It" || resp.Header.Get("X-Length") != "9" || string(body) != "some data" {
+		t.Errorf("POST got %s %v %q", resp.Status, resp.Header, body)
+	}
+
+	resp, err = client.Get("http://example.com/trailers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resp.Trailer["X-Sum"]; !ok {
+		t.Errorf("Trailer was not announced: %v", resp.Trailer)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "hello world" || resp.Trailer.Get("X-Sum") != "42" {
+		t.Errorf("Chunked body %q, trailers %v, %v", body, resp.Trailer, err)
+	}
+
+	// Through a reverse proxy, which keeps the original Host.
+	target, _ := url.Parse("http://backend/")
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = client.Transport
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://frontend/?c=d", nil))
+	if w.Code != 200 || w.Body.String() != "frontend c=d" {
+		t.Errorf("Proxy got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestTransportErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	client := &http.Client{Transport: NewTransport(NewFCGI(l.Addr().String()))}
+	_, err = client.Get("http://example.com/")
+	var dial *DialError
+	if !errors.As(err, &dial) {
+		t.Errorf("Dial failure returned %v", err)
+	}
+
+	client.Transport = NewTransport(RequesterFunc(func(env []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+		_, err := io.WriteString(stdout, "garbage")
+		return err
+	}))
+	_, err = client.Get("http://example.com/")
+	var malformed *MalformedResponseError
+	if !errors.As(err, &malformed) {
+		t.Errorf("Malformed response returned %v", err)
+	}
+}